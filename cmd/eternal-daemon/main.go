@@ -1,22 +1,34 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"syscall"
+	"time"
 
 	"github.com/Magnetkopf/Eternal/internal/api"
 	"github.com/Magnetkopf/Eternal/internal/config"
 	"github.com/Magnetkopf/Eternal/internal/ipc"
+	"github.com/Magnetkopf/Eternal/internal/logs"
 	"github.com/Magnetkopf/Eternal/internal/process"
 )
 
 func main() {
+	// Started by the daemon itself to set resource limits for a service
+	if len(os.Args) > 1 && os.Args[1] == process.LimitsShim {
+		process.RunLimitsShim(os.Args[2:])
+	}
+
 	// 1. Initialize Process Manager
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -31,68 +43,244 @@ func main() {
 		log.Fatalf("Failed to create services directory: %v", err)
 	}
 
-	pm := process.NewManager(servicesDir)
+	// Load system configuration (auth token, API port, log defaults)
+	configFile := filepath.Join(baseDir, "config.yaml")
+	cfg, err := config.LoadOrGenerateSystemConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load system config: %v", err)
+	}
+
+	// A daemon re-executed by an upgrade inherits listeners and services
+	handover, err := loadHandover()
+	if err != nil {
+		log.Fatalf("Failed to take over from the previous daemon: %v", err)
+	}
+
+	pm := process.NewManager(baseDir, cfg)
 	if err := pm.LoadServices(); err != nil {
 		log.Printf("Warning: Failed to load some services: %v", err)
 	}
 
-	// Auto-start enabled services
+	// Orphans of services are reparented to the daemon, which lets it follow
+	// forking services and reap their leftovers. PID 1 gets them anyway.
+	if os.Getpid() != 1 {
+		if err := process.BecomeSubreaper(); err != nil {
+			log.Printf("Failed to become child subreaper: %v", err)
+		}
+	}
+
+	// Resource control needs a delegated cgroup v2 subtree. After an upgrade
+	// the daemon is inside the subtree it set up before.
+	if handover == nil {
+		if err := pm.SetupCgroups(); err != nil {
+			log.Printf("cgroup v2 resource control unavailable: %v", err)
+		}
+	} else if handover.CgroupBase != "" {
+		if err := pm.ResumeCgroups(handover.CgroupBase); err != nil {
+			log.Printf("cgroup v2 resource control unavailable: %v", err)
+		}
+	}
+
+	// Container init mode: live as long as the primary service
+	initMode := cfg.Init || os.Getpid() == 1
+	primaryExited := make(chan error, 1)
+	if initMode {
+		if cfg.ShutdownMode == config.ShutdownDetach {
+			log.Println("Init mode cannot leave services running, stopping them on shutdown instead")
+			cfg.ShutdownMode = config.ShutdownStop
+		}
+		if cfg.Primary != "" {
+			pm.SetExitHandler(func(name string, exitErr error) {
+				if name == cfg.Primary {
+					select {
+					case primaryExited <- exitErr:
+					default:
+					}
+				}
+			})
+		}
+	}
+
+	// Re-attach to services left running by a previous daemon instance
+	adopted := make(map[string]bool)
+	if handover != nil {
+		running := pm.TakeOver(handover.Processes)
+		log.Printf("Upgraded, took over %d running services", len(running))
+	} else {
+		for _, name := range pm.AdoptRunning() {
+			adopted[name] = true
+			log.Printf("Re-attached to running service %s", name)
+		}
+	}
+
+	// Auto-start enabled services, unless the previous instance already did
+	var autoStart []string
 	enabledServices, err := config.LoadEnabledServices(enabledFile)
 	if err != nil {
 		log.Printf("Warning: Failed to load enabled services: %v", err)
-	} else {
+	} else if handover == nil {
 		for _, name := range enabledServices {
-			if err := pm.StartService(name); err != nil {
+			if adopted[name] {
+				continue
+			}
+			if pm.StoppedByUser(name) {
+				log.Printf("Not auto-starting service %s: stopped by user", name)
+				continue
+			}
+			autoStart = append(autoStart, name)
+		}
+	}
+
+	// Waiting for dependencies to become ready must not hold up the daemon
+	go func() {
+		// Independent services start in parallel, dependencies first
+		results := pm.StartServices(autoStart, false)
+		for _, name := range autoStart {
+			if err := results[name]; err != nil {
 				log.Printf("Failed to auto-start service %s: %v", name, err)
 			} else {
 				log.Printf("Auto-started service %s", name)
 			}
 		}
-	}
+
+		// The primary service runs whether it is enabled or not
+		if initMode && cfg.Primary != "" && handover == nil {
+			status, err := pm.GetStatus(cfg.Primary)
+			if err != nil || (status != process.StatusRunning && status != process.StatusStarting) {
+				if err := pm.StartService(cfg.Primary); err != nil {
+					log.Printf("Failed to start primary service %s: %v", cfg.Primary, err)
+					primaryExited <- err
+				} else {
+					log.Printf("Started primary service %s", cfg.Primary)
+				}
+			}
+		}
+	}()
 
 	// 2. Setup Socket
 	socketPath := filepath.Join(baseDir, "eternal.sock")
-	if err := os.RemoveAll(socketPath); err != nil {
-		log.Fatalf("Failed to remove old socket: %v", err)
-	}
-
-	listener, err := net.Listen("unix", socketPath)
+	listener, err := listenSocket(socketPath, handover)
 	if err != nil {
 		log.Fatalf("Failed to listen on socket: %v", err)
 	}
-	defer listener.Close()
 
-	// 3. Handle Signals for Graceful Shutdown
+	// 3. Handle Signals for Graceful Shutdown and Upgrades
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		log.Println("Shutting down...")
-		// Stop all services? For now, we trust the OS or Process Manager if we added StopAll method.
-		// Since we didn't add StopAll, we might leave them running or kill them.
-		// Systemd leaves them running usually, but eternal-daemon maybe should kill them if it's the parent.
-		// Let's just exit for now.
-		// Ideally: pm.StopAll()
-		os.Exit(0)
-	}()
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR2)
 
 	log.Println("Eternal Daemon started, listening on", socketPath)
 
-	// Load Auth Token
-	configFile := filepath.Join(baseDir, "config.yaml")
-	cfg, err := config.LoadOrGenerateSystemConfig(configFile)
-	if err != nil {
-		log.Fatalf("Failed to load auth token: %v", err)
-	}
 	log.Printf("Auth token: %s", cfg.Token)
 
 	// Start API Server
-	go api.StartServer(pm, cfg.APIPort, servicesDir, enabledFile, cfg.Token)
+	metrics := api.MetricsOptions{Listen: cfg.MetricsListen, Auth: cfg.MetricsAuthRequired()}
+	apiServer := api.NewServer(pm, cfg.APIPort, servicesDir, enabledFile, cfg.Token, metrics)
+	var apiListener net.Listener
+	if handover != nil && handover.APIFD != 0 {
+		apiListener, err = inheritedListener(handover.APIFD, "api")
+	} else {
+		apiListener, err = apiServer.Listen()
+	}
+	if err != nil {
+		log.Printf("API Server failed: %v", err)
+	} else {
+		go func() {
+			if err := apiServer.Serve(apiListener); err != nil {
+				log.Printf("API Server failed: %v", err)
+			}
+		}()
+	}
+
+	// Metrics on their own address, if configured
+	var metricsListener net.Listener
+	if handover != nil && handover.MetricsFD != 0 {
+		metricsListener, err = inheritedListener(handover.MetricsFD, "metrics")
+	} else {
+		metricsListener, err = apiServer.ListenMetrics()
+	}
+	if err != nil {
+		log.Printf("Metrics server failed: %v", err)
+	} else if metricsListener != nil {
+		go func() {
+			if err := apiServer.ServeMetrics(metricsListener); err != nil {
+				log.Printf("Metrics server failed: %v", err)
+			}
+		}()
+	}
 
 	// 4. Accept Connections
+	go acceptConnections(listener, pm)
+
+	exitCode := 0
+	for {
+		select {
+		case exitErr := <-primaryExited:
+			exitCode = process.ExitCode(exitErr)
+			if exitErr == nil {
+				log.Printf("Primary service %s exited, shutting down...", cfg.Primary)
+			} else {
+				log.Printf("Primary service %s failed (%v), shutting down...", cfg.Primary, exitErr)
+			}
+		case sig := <-sigChan:
+			if sig != syscall.SIGUSR2 {
+				log.Printf("Received %s, shutting down...", sig)
+				break
+			}
+			if err := upgrade(listener, apiListener, metricsListener, pm); err != nil {
+				log.Printf("Upgrade failed: %v", err)
+			}
+			continue
+		case <-upgradeRequests:
+			if err := upgrade(listener, apiListener, metricsListener, pm); err != nil {
+				log.Printf("Upgrade failed: %v", err)
+			}
+			continue
+		}
+		break
+	}
+	go func() {
+		// A second signal skips the graceful part
+		<-sigChan
+		log.Println("Forced shutdown, killing services")
+		pm.KillAll()
+		os.Exit(1)
+	}()
+
+	shutdown(cfg, pm, apiServer, listener)
+	os.Exit(exitCode)
+}
+
+// listenSocket opens the unix socket, or takes it over from the previous
+// daemon instance
+func listenSocket(socketPath string, handover *handoverState) (*net.UnixListener, error) {
+	if handover != nil && handover.SocketFD != 0 {
+		l, err := inheritedListener(handover.SocketFD, "socket")
+		if err != nil {
+			return nil, err
+		}
+		listener := l.(*net.UnixListener)
+		// Remove the socket file on shutdown like a listener we created
+		listener.SetUnlinkOnClose(true)
+		return listener, nil
+	}
+
+	if err := os.RemoveAll(socketPath); err != nil {
+		return nil, fmt.Errorf("failed to remove old socket: %w", err)
+	}
+	addr, err := net.ResolveUnixAddr("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUnix("unix", addr)
+}
+
+func acceptConnections(listener net.Listener, pm *process.Manager) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("Accept error: %v", err)
 			continue
 		}
@@ -100,6 +288,35 @@ func main() {
 	}
 }
 
+// shutdown closes the control interfaces and then deals with the services
+// according to the configured shutdown mode
+func shutdown(cfg config.SystemConfig, pm *process.Manager, apiServer *api.Server, listener net.Listener) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop taking requests first, so nothing starts services behind our back.
+	// Closing the listener also removes the socket file.
+	listener.Close()
+	if err := apiServer.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down API server: %v", err)
+	}
+
+	switch cfg.ShutdownMode {
+	case config.ShutdownDetach:
+		log.Println("Leaving services running")
+	case config.ShutdownKill:
+		log.Println("Killing all services")
+		pm.KillAll()
+	default:
+		log.Println("Stopping all services")
+		if err := pm.StopAll(ctx); err != nil {
+			log.Printf("Failed to stop all services: %v", err)
+		}
+	}
+
+	log.Println("Shutdown complete")
+}
+
 func handleConnection(conn net.Conn, pm *process.Manager) {
 	defer conn.Close()
 
@@ -112,23 +329,39 @@ func handleConnection(conn net.Conn, pm *process.Manager) {
 		return
 	}
 
+	if req.Type == ipc.RequestLogs {
+		handleLogs(conn, encoder, req, pm)
+		return
+	}
+
 	var resp ipc.Response
 
 	switch req.Type {
 	case ipc.RequestStart:
-		err := pm.StartService(req.Service)
+		var err error
+		if req.Wait {
+			err = pm.StartServiceWait(req.Service)
+		} else {
+			err = pm.StartService(req.Service)
+		}
 		if err != nil {
 			resp.Success = false
 			resp.Message = err.Error()
+		} else if req.Wait {
+			resp.Success = true
+			resp.Message = fmt.Sprintf("Service %s started and ready", req.Service)
 		} else {
 			resp.Success = true
 			resp.Message = fmt.Sprintf("Service %s started", req.Service)
 		}
 	case ipc.RequestStop:
-		err := pm.StopService(req.Service)
+		result, err := pm.StopService(req.Service)
 		if err != nil {
 			resp.Success = false
 			resp.Message = err.Error()
+		} else if result == process.StopKilled {
+			resp.Success = true
+			resp.Message = fmt.Sprintf("Service %s killed after stop timeout", req.Service)
 		} else {
 			resp.Success = true
 			resp.Message = fmt.Sprintf("Service %s stopped", req.Service)
@@ -141,7 +374,24 @@ func handleConnection(conn net.Conn, pm *process.Manager) {
 		} else {
 			resp.Success = true
 			resp.Message = string(status)
+			if health := pm.Health(req.Service); health != "" {
+				resp.Message += " (" + string(health) + ")"
+			}
+			resp.Data, _ = json.Marshal([]ipc.ServiceInfo{serviceInfo(pm, req.Service, status)})
+		}
+	case ipc.RequestList:
+		statuses := pm.ListServices()
+		names := make([]string, 0, len(statuses))
+		for name := range statuses {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([]ipc.ServiceInfo, 0, len(names))
+		for _, name := range names {
+			list = append(list, serviceInfo(pm, name, statuses[name]))
 		}
+		resp.Data, _ = json.Marshal(list)
+		resp.Success = true
 	case ipc.RequestRestart:
 		err := pm.RestartService(req.Service)
 		if err != nil {
@@ -151,6 +401,34 @@ func handleConnection(conn net.Conn, pm *process.Manager) {
 			resp.Success = true
 			resp.Message = fmt.Sprintf("Service %s restarted", req.Service)
 		}
+	case ipc.RequestReset:
+		err := pm.ResetService(req.Service)
+		if err != nil {
+			resp.Success = false
+			resp.Message = err.Error()
+		} else {
+			resp.Success = true
+			resp.Message = fmt.Sprintf("Service %s reset", req.Service)
+		}
+	case ipc.RequestHistory:
+		runs, err := pm.Runs(req.Service)
+		if err == nil {
+			resp.Data, err = json.Marshal(runs)
+		}
+		if err != nil {
+			resp.Success = false
+			resp.Message = err.Error()
+		} else {
+			resp.Success = true
+		}
+	case ipc.RequestUpgrade:
+		if exe, err := upgradeBinary(); err != nil {
+			resp.Success = false
+			resp.Message = err.Error()
+		} else {
+			resp.Success = true
+			resp.Message = fmt.Sprintf("Upgrading daemon to %s", exe)
+		}
 	default:
 		resp.Success = false
 		resp.Message = "Unknown request type"
@@ -159,4 +437,63 @@ func handleConnection(conn net.Conn, pm *process.Manager) {
 	if err := encoder.Encode(resp); err != nil {
 		log.Printf("Failed to send response: %v", err)
 	}
+
+	// Trigger the upgrade only after replying, the exec closes the connection
+	if req.Type == ipc.RequestUpgrade && resp.Success {
+		select {
+		case upgradeRequests <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// serviceInfo describes a service for RequestStatus and RequestList
+func serviceInfo(pm *process.Manager, name string, status process.ProcessStatus) ipc.ServiceInfo {
+	info := ipc.ServiceInfo{
+		Name:   name,
+		Status: string(status),
+		Health: string(pm.Health(name)),
+	}
+	info.Stats, _ = pm.Stats(name)
+	return info
+}
+
+// handleLogs answers a RequestLogs with a Response followed by the raw lines
+func handleLogs(conn net.Conn, encoder *json.Encoder, req ipc.Request, pm *process.Manager) {
+	since, err := logs.ParseSince(req.Since, time.Now())
+	if err == nil {
+		_, _, err = pm.LogPaths(req.Service)
+	}
+	if err != nil {
+		encoder.Encode(ipc.Response{Success: false, Message: err.Error()})
+		return
+	}
+	if err := encoder.Encode(ipc.Response{Success: true}); err != nil {
+		log.Printf("Failed to send response: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The client sends nothing after its request, so a finished read means it went away
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	writer := bufio.NewWriter(conn)
+	opts := logs.StreamOptions{Lines: req.Lines, Since: since, Follow: req.Follow}
+	err = pm.StreamLogs(ctx, req.Service, req.Stderr, opts, func(line []byte) error {
+		writer.Write(line)
+		writer.WriteByte('\n')
+		if req.Follow {
+			// Deliver lines as they are written
+			return writer.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to stream logs of %s: %v", req.Service, err)
+	}
+	writer.Flush()
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/Magnetkopf/Eternal/internal/process"
+)
+
+// upgradeEnv carries the handover state to the re-executed daemon
+const upgradeEnv = "ETERNAL_UPGRADE"
+
+// upgradeRequests asks the main loop to upgrade, like SIGUSR2 does
+var upgradeRequests = make(chan struct{}, 1)
+
+// handoverState is what a daemon passes to its re-executed binary
+type handoverState struct {
+	// SocketFD, APIFD and MetricsFD are the inherited listeners, 0 if absent
+	SocketFD  int `json:"socket_fd"`
+	APIFD     int `json:"api_fd,omitempty"`
+	MetricsFD int `json:"metrics_fd,omitempty"`
+	// CgroupBase is the cgroup set up for resource control, if any
+	CgroupBase string                    `json:"cgroup_base,omitempty"`
+	Processes  []process.HandoverProcess `json:"processes"`
+}
+
+// loadHandover returns the state passed by the previous daemon instance,
+// or nil if this daemon was started normally
+func loadHandover() (*handoverState, error) {
+	data, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return nil, nil
+	}
+	// Services must not inherit it
+	os.Unsetenv(upgradeEnv)
+
+	var state handoverState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, fmt.Errorf("failed to parse handover state: %w", err)
+	}
+	return &state, nil
+}
+
+// inheritedListener rebuilds a listener from a file descriptor left open by
+// the previous daemon instance
+func inheritedListener(fd int, name string) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// upgradeBinary returns the daemon binary to re-execute. The file at the
+// original path may have been replaced since the daemon started.
+func upgradeBinary() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate daemon binary: %w", err)
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return "", fmt.Errorf("failed to find daemon binary: %w", err)
+	}
+	if info.Mode()&0111 == 0 {
+		return "", fmt.Errorf("daemon binary %s is not executable", exe)
+	}
+	return exe, nil
+}
+
+// upgrade re-executes the daemon binary in place, passing on the listeners
+// and the process table. The PID stays the same, so the services remain our
+// children. It only returns if the upgrade failed.
+func upgrade(listener *net.UnixListener, apiListener, metricsListener net.Listener, pm *process.Manager) error {
+	exe, err := upgradeBinary()
+	if err != nil {
+		return err
+	}
+
+	var state handoverState
+	var inherited []syscall.Conn
+	restore := func() {
+		for _, c := range inherited {
+			process.SetInheritable(c, false)
+		}
+	}
+
+	if state.SocketFD, err = process.SetInheritable(listener, true); err != nil {
+		return fmt.Errorf("failed to pass socket: %w", err)
+	}
+	inherited = append(inherited, listener)
+	if c, ok := apiListener.(syscall.Conn); ok {
+		if state.APIFD, err = process.SetInheritable(c, true); err != nil {
+			restore()
+			return fmt.Errorf("failed to pass API listener: %w", err)
+		}
+		inherited = append(inherited, c)
+	}
+	if c, ok := metricsListener.(syscall.Conn); ok {
+		if state.MetricsFD, err = process.SetInheritable(c, true); err != nil {
+			restore()
+			return fmt.Errorf("failed to pass metrics listener: %w", err)
+		}
+		inherited = append(inherited, c)
+	}
+
+	// Read before BeginHandover, which keeps the manager locked
+	state.CgroupBase = pm.CgroupBase()
+	if state.Processes, err = pm.BeginHandover(); err != nil {
+		restore()
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		log.Printf("Upgrading daemon, re-executing %s", exe)
+		env := append(os.Environ(), upgradeEnv+"="+string(data))
+		err = syscall.Exec(exe, os.Args, env)
+	}
+
+	pm.AbortHandover()
+	restore()
+	return fmt.Errorf("failed to execute %s: %w", exe, err)
+}
@@ -1,19 +1,34 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Magnetkopf/Eternal/internal/config"
 	"github.com/Magnetkopf/Eternal/internal/ipc"
+	"github.com/Magnetkopf/Eternal/internal/process"
 )
 
 func main() {
+	// Without a service name, status lists all services like list does
+	if len(os.Args) == 2 && (os.Args[1] == "list" || os.Args[1] == "status") {
+		handleStatus("")
+		return
+	}
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: eternal [start|stop|restart|status|enable|disable|new|delete] <service_name>")
+		fmt.Println("Usage: eternal [start|stop|restart|status|reset|logs|history|enable|disable|new|delete] <service_name>")
+		fmt.Println("       eternal start --wait <service_name>")
+		fmt.Println("       eternal [list|status]")
+		fmt.Println("       eternal daemon upgrade")
 		os.Exit(1)
 	}
 
@@ -23,13 +38,17 @@ func main() {
 	var reqType ipc.RequestType
 	switch cmd {
 	case "start":
-		reqType = ipc.RequestStart
+		handleStart(os.Args[2:])
+		return
 	case "stop":
 		reqType = ipc.RequestStop
 	case "status":
-		reqType = ipc.RequestStatus
+		handleStatus(service)
+		return
 	case "restart":
 		reqType = ipc.RequestRestart
+	case "reset":
+		reqType = ipc.RequestReset
 	case "enable":
 		handleEnable(service)
 		return
@@ -42,6 +61,15 @@ func main() {
 	case "delete":
 		handleDelete(service)
 		return
+	case "logs":
+		handleLogs(os.Args[2:])
+		return
+	case "history":
+		handleHistory(service)
+		return
+	case "daemon":
+		handleDaemon(service)
+		return
 	default:
 		fmt.Printf("Unknown command: %s\n", cmd)
 		os.Exit(1)
@@ -50,6 +78,32 @@ func main() {
 	sendRequest(reqType, service)
 }
 
+func handleStart(args []string) {
+	flags := flag.NewFlagSet("start", flag.ExitOnError)
+	wait := flags.Bool("wait", false, "wait until the service is ready, or for oneshot services, finished")
+	flags.Usage = func() {
+		fmt.Println("Usage: eternal start [--wait] <service_name>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	// Allow the flag after the service name as well
+	service := flags.Arg(0)
+	if flags.NArg() > 1 {
+		flags.Parse(flags.Args()[1:])
+	}
+	if service == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	resp := request(ipc.Request{
+		Type:    ipc.RequestStart,
+		Service: service,
+		Wait:    *wait,
+	})
+	fmt.Println(resp.Message)
+}
+
 func handleEnable(service string) {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -106,10 +160,12 @@ func handleNew(service string) {
 		os.Exit(1)
 	}
 
-	defaultContent := `# Command to execute
+	defaultContent := `# Command to execute, quotes and backslash escapes work like in a shell
 exec: ""
 # Working directory
 dir: ""
+# Restart policy: no, always, on-failure, unless-stopped
+restart: "no"
 `
 	if err := os.WriteFile(serviceFile, []byte(defaultContent), 0644); err != nil {
 		fmt.Printf("Failed to create service file: %v\n", err)
@@ -150,7 +206,169 @@ func handleDelete(service string) {
 	fmt.Printf("Service %s deleted\n", service)
 }
 
-func sendRequest(reqType ipc.RequestType, service string) {
+func handleLogs(args []string) {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	lines := flags.Int("n", 100, "number of lines to show, 0 for all")
+	follow := flags.Bool("f", false, "keep printing new lines as they are written")
+	since := flags.String("since", "", "only show lines newer than a duration (10m) or RFC 3339 time")
+	stderr := flags.Bool("stderr", false, "show the stderr log instead of stdout")
+	flags.Usage = func() {
+		fmt.Println("Usage: eternal logs [-n 100] [-f] [--since 10m] [--stderr] <service_name>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	// Allow the flags after the service name as well
+	service := flags.Arg(0)
+	if flags.NArg() > 1 {
+		flags.Parse(flags.Args()[1:])
+	}
+	if service == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	conn := dialDaemon()
+	defer conn.Close()
+
+	req := ipc.Request{
+		Type:    ipc.RequestLogs,
+		Service: service,
+		Lines:   *lines,
+		Follow:  *follow,
+		Since:   *since,
+		Stderr:  *stderr,
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		fmt.Printf("Failed to send request: %v\n", err)
+		os.Exit(1)
+	}
+
+	var resp ipc.Response
+	decoder := json.NewDecoder(conn)
+	if err := decoder.Decode(&resp); err != nil {
+		fmt.Printf("Failed to read response: %v\n", err)
+		os.Exit(1)
+	}
+	if !resp.Success {
+		fmt.Printf("Error: %s\n", resp.Message)
+		os.Exit(1)
+	}
+
+	// The lines follow the response, part of them may already be buffered.
+	// Skip the newline that terminates the JSON response.
+	stream := bufio.NewReader(io.MultiReader(decoder.Buffered(), conn))
+	if b, err := stream.Peek(1); err == nil && b[0] == '\n' {
+		stream.Discard(1)
+	}
+	io.Copy(os.Stdout, stream)
+}
+
+func handleHistory(service string) {
+	resp := request(ipc.Request{Type: ipc.RequestHistory, Service: service})
+
+	var runs []process.Run
+	if err := json.Unmarshal(resp.Data, &runs); err != nil {
+		fmt.Printf("Failed to read run history: %v\n", err)
+		os.Exit(1)
+	}
+	if len(runs) == 0 {
+		fmt.Printf("Service %s has not run yet\n", service)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tENDED\tDURATION\tEXIT\tRESULT")
+	for _, run := range runs {
+		exit := strconv.Itoa(run.ExitCode)
+		if run.ExitCode < 0 {
+			exit = "?"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			run.StartedAt.Local().Format(time.DateTime),
+			run.EndedAt.Local().Format(time.DateTime),
+			run.Duration().Round(time.Millisecond),
+			exit,
+			run.Result)
+	}
+	w.Flush()
+}
+
+// handleStatus prints the state and resource usage of a service, or of all
+// services if service is empty
+func handleStatus(service string) {
+	req := ipc.Request{Type: ipc.RequestList}
+	if service != "" {
+		req = ipc.Request{Type: ipc.RequestStatus, Service: service}
+	}
+	resp := request(req)
+
+	// Older daemons only send the status as message
+	if len(resp.Data) == 0 {
+		fmt.Println(resp.Message)
+		return
+	}
+	var list []ipc.ServiceInfo
+	if err := json.Unmarshal(resp.Data, &list); err != nil {
+		fmt.Printf("Failed to read status: %v\n", err)
+		os.Exit(1)
+	}
+	if len(list) == 0 {
+		fmt.Println("No services configured")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tPID\tCPU\tMEMORY\tTHREADS\tFDS\tUPTIME")
+	for _, info := range list {
+		status := info.Status
+		if info.Health != "" {
+			status += " (" + info.Health + ")"
+		}
+		if info.Stats == nil {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t-\t-\n", info.Name, status)
+			continue
+		}
+		st := info.Stats
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.1f%%\t%s\t%d\t%d\t%s\n",
+			info.Name,
+			status,
+			st.PID,
+			st.CPUPercent,
+			formatSize(st.MemoryRSS),
+			st.Threads,
+			st.FDs,
+			st.Uptime.Round(time.Second))
+	}
+	w.Flush()
+}
+
+// formatSize formats a size in bytes with a binary unit, e.g. 12.5M
+func formatSize(bytes uint64) string {
+	const units = "KMGTPE"
+	if bytes < 1024 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	value := float64(bytes) / 1024
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", value, units[unit])
+}
+
+func handleDaemon(action string) {
+	switch action {
+	case "upgrade":
+		sendRequest(ipc.RequestUpgrade, "")
+	default:
+		fmt.Printf("Unknown daemon command: %s\n", action)
+		os.Exit(1)
+	}
+}
+
+func dialDaemon() net.Conn {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		fmt.Printf("Failed to get user home: %v\n", err)
@@ -164,12 +382,13 @@ func sendRequest(reqType ipc.RequestType, service string) {
 		fmt.Println("Is eternal-daemon running?")
 		os.Exit(1)
 	}
-	defer conn.Close()
+	return conn
+}
 
-	req := ipc.Request{
-		Type:    reqType,
-		Service: service,
-	}
+// request sends a request to the daemon and returns its successful response
+func request(req ipc.Request) ipc.Response {
+	conn := dialDaemon()
+	defer conn.Close()
 
 	encoder := json.NewEncoder(conn)
 	if err := encoder.Encode(req); err != nil {
@@ -184,10 +403,17 @@ func sendRequest(reqType ipc.RequestType, service string) {
 		os.Exit(1)
 	}
 
-	if resp.Success {
-		fmt.Println(resp.Message)
-	} else {
+	if !resp.Success {
 		fmt.Printf("Error: %s\n", resp.Message)
 		os.Exit(1)
 	}
+	return resp
+}
+
+func sendRequest(reqType ipc.RequestType, service string) {
+	resp := request(ipc.Request{
+		Type:    reqType,
+		Service: service,
+	})
+	fmt.Println(resp.Message)
 }
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Magnetkopf/Eternal/internal/process"
+)
+
+// MetricsOptions configures the Prometheus /metrics endpoint
+type MetricsOptions struct {
+	// Listen is an additional address serving only /metrics, if set
+	Listen string
+	// Auth requires the access token for /metrics
+	Auth bool
+}
+
+// daemonStart is when the daemon process started
+var daemonStart = time.Now()
+
+// requestKey identifies a counter of API requests
+type requestKey struct {
+	route string
+	code  int
+}
+
+// requestCounter counts the API requests by route and status code
+type requestCounter struct {
+	mu     sync.Mutex
+	counts map[requestKey]uint64
+}
+
+func (c *requestCounter) add(route string, code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[requestKey]uint64)
+	}
+	c.counts[requestKey{route, code}]++
+}
+
+// snapshot returns the counters ordered by route and code
+func (c *requestCounter) snapshot() ([]requestKey, map[requestKey]uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]requestKey, 0, len(c.counts))
+	counts := make(map[requestKey]uint64, len(c.counts))
+	for k, v := range c.counts {
+		keys = append(keys, k)
+		counts[k] = v
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].code < keys[j].code
+	})
+	return keys, counts
+}
+
+// countRequests counts the requests handled by next. The route is the
+// pattern of the matched handler, so service names do not end up as labels.
+func (c *requestCounter) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		c.add(route, rec.code)
+	})
+}
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush passes on flushes, followed log streams rely on them
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// handleMetrics serves the state of the daemon and its services in the
+// Prometheus text exposition format
+func (h *handler) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	e := &exposition{w: out}
+	e.family("eternal_daemon_start_time_seconds", "gauge", "Start time of the daemon since the Unix epoch in seconds.")
+	e.sample("eternal_daemon_start_time_seconds", nil, float64(daemonStart.UnixNano())/1e9)
+
+	keys, counts := h.requests.snapshot()
+	e.family("eternal_api_requests_total", "counter", "API requests by route and status code.")
+	for _, k := range keys {
+		e.sample("eternal_api_requests_total", []string{"route", k.route, "code", strconv.Itoa(k.code)}, float64(counts[k]))
+	}
+
+	services := h.pm.Metrics()
+	e.family("eternal_service_up", "gauge", "Whether the service is running (1) or not (0).")
+	for _, s := range services {
+		up := 0.0
+		if s.Status == process.StatusRunning || s.Status == process.StatusStarting {
+			up = 1
+		}
+		e.sample("eternal_service_up", []string{"service", s.Name}, up)
+	}
+	e.family("eternal_service_status", "gauge", "Current status of the service, always 1.")
+	for _, s := range services {
+		e.sample("eternal_service_status", []string{"service", s.Name, "status", string(s.Status)}, 1)
+	}
+	e.family("eternal_service_healthy", "gauge", "Whether the health check of the service passes (1) or fails (0).")
+	for _, s := range services {
+		switch s.Health {
+		case process.HealthHealthy:
+			e.sample("eternal_service_healthy", []string{"service", s.Name}, 1)
+		case process.HealthUnhealthy:
+			e.sample("eternal_service_healthy", []string{"service", s.Name}, 0)
+		}
+	}
+	e.family("eternal_service_restarts_total", "counter", "Automatic restarts of the service since the daemon started.")
+	for _, s := range services {
+		e.sample("eternal_service_restarts_total", []string{"service", s.Name}, float64(s.Restarts))
+	}
+	e.family("eternal_service_last_exit_code", "gauge", "Exit code of the last run of the service, 128+n after signal n, -1 if unknown.")
+	for _, s := range services {
+		if s.LastRun != nil {
+			e.sample("eternal_service_last_exit_code", []string{"service", s.Name}, float64(s.LastRun.ExitCode))
+		}
+	}
+	e.family("eternal_service_start_time_seconds", "gauge", "Start time of the running service since the Unix epoch in seconds.")
+	for _, s := range services {
+		if !s.StartedAt.IsZero() {
+			e.sample("eternal_service_start_time_seconds", []string{"service", s.Name}, float64(s.StartedAt.UnixNano())/1e9)
+		}
+	}
+
+	// Only the cgroup accounts the CPU time of processes that exited
+	e.family("eternal_service_cpu_seconds_total", "counter", "CPU time used in the cgroup of the service over all its runs in seconds.")
+	for _, s := range services {
+		if s.CgroupCPUSeconds != nil {
+			e.sample("eternal_service_cpu_seconds_total", []string{"service", s.Name}, *s.CgroupCPUSeconds)
+		}
+	}
+
+	usage := []struct {
+		name, kind, help string
+		value            func(*process.Stats) float64
+	}{
+		{"eternal_service_cpu_seconds", "gauge", "CPU time used by the live processes of the service in seconds.",
+			func(st *process.Stats) float64 { return st.CPUSeconds }},
+		{"eternal_service_memory_rss_bytes", "gauge", "Resident memory of the processes of the service in bytes.",
+			func(st *process.Stats) float64 { return float64(st.MemoryRSS) }},
+		{"eternal_service_threads", "gauge", "Threads of the processes of the service.",
+			func(st *process.Stats) float64 { return float64(st.Threads) }},
+		{"eternal_service_open_fds", "gauge", "Open file descriptors of the processes of the service.",
+			func(st *process.Stats) float64 { return float64(st.FDs) }},
+		{"eternal_service_processes", "gauge", "Processes of the service, the main one included.",
+			func(st *process.Stats) float64 { return float64(st.Processes) }},
+	}
+	for _, u := range usage {
+		e.family(u.name, u.kind, u.help)
+		for _, s := range services {
+			if s.Usage != nil {
+				e.sample(u.name, []string{"service", s.Name}, u.value(s.Usage))
+			}
+		}
+	}
+}
+
+// exposition writes metrics in the Prometheus text format
+type exposition struct {
+	w *bufio.Writer
+}
+
+func (e *exposition) family(name, kind, help string) {
+	fmt.Fprintf(e.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value, labels holds name and value pairs
+func (e *exposition) sample(name string, labels []string, value float64) {
+	e.w.WriteString(name)
+	if len(labels) > 0 {
+		e.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				e.w.WriteByte(',')
+			}
+			fmt.Fprintf(e.w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		e.w.WriteByte('}')
+	}
+	e.w.WriteByte(' ')
+	e.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	e.w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
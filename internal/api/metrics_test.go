@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+	"github.com/Magnetkopf/Eternal/internal/process"
+)
+
+const testToken = "secret"
+
+// newTestServer returns a server managing a stopped service named web
+func newTestServer(t *testing.T, metrics MetricsOptions) *Server {
+	t.Helper()
+	base := t.TempDir()
+	servicesDir := filepath.Join(base, "services")
+	if err := os.MkdirAll(servicesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(servicesDir, "web.yaml"), []byte("exec: sleep 100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pm := process.NewManager(base, config.SystemConfig{})
+	if err := pm.LoadServices(); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(pm, 0, servicesDir, filepath.Join(base, "enabled.yaml"), testToken, metrics)
+}
+
+// get serves a GET request for path, with the access token if token is set
+func get(handler http.Handler, path string, token bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if token {
+		req.Header.Set("access-token", testToken)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandleMetrics(t *testing.T) {
+	s := newTestServer(t, MetricsOptions{Auth: true})
+	handler := s.httpServer.Handler
+
+	// Counted, so the second scrape reports it
+	get(handler, "/v1/processes", true)
+	rec := get(handler, "/metrics", true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# HELP eternal_daemon_start_time_seconds Start time of the daemon since the Unix epoch in seconds.\n# TYPE eternal_daemon_start_time_seconds gauge\n",
+		"# TYPE eternal_api_requests_total counter\n",
+		`eternal_api_requests_total{route="GET /v1/processes",code="200"} 1` + "\n",
+		"# TYPE eternal_service_up gauge\n",
+		`eternal_service_up{service="web"} 0` + "\n",
+		`eternal_service_status{service="web",status="stopped"} 1` + "\n",
+		"# TYPE eternal_service_restarts_total counter\n",
+		`eternal_service_restarts_total{service="web"} 0` + "\n",
+		"# TYPE eternal_service_cpu_seconds_total counter\n",
+		"# TYPE eternal_service_cpu_seconds gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+
+	// Every sample belongs to the family announced before it
+	var family string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			family, _, _ = strings.Cut(name, " ")
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, _, _ := strings.Cut(line, "{")
+		name, _, _ = strings.Cut(name, " ")
+		if name != family {
+			t.Errorf("sample %q outside of its family, last TYPE was %s", line, family)
+		}
+	}
+}
+
+func TestExpositionEscapesLabels(t *testing.T) {
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	e := &exposition{w: w}
+	e.family("test_metric", "gauge", "A test.")
+	e.sample("test_metric", nil, 1.5)
+	e.sample("test_metric", []string{"service", `back\slash`, "path", `say "hi"`}, 2)
+	e.sample("test_metric", []string{"service", "two\nlines"}, 1e21)
+	w.Flush()
+
+	want := "# HELP test_metric A test.\n" +
+		"# TYPE test_metric gauge\n" +
+		"test_metric 1.5\n" +
+		`test_metric{service="back\\slash",path="say \"hi\""} 2` + "\n" +
+		`test_metric{service="two\nlines"} 1e+21` + "\n"
+	if sb.String() != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	tests := []struct {
+		auth  bool
+		path  string
+		token bool
+		want  int
+	}{
+		{true, "/metrics", false, http.StatusUnauthorized},
+		{true, "/metrics", true, http.StatusOK},
+		{false, "/metrics", false, http.StatusOK},
+		{false, "/metrics", true, http.StatusOK},
+		// Only /metrics is exempted
+		{false, "/v1/processes", false, http.StatusUnauthorized},
+		{false, "/v1/processes/web", false, http.StatusUnauthorized},
+		{false, "/metrics/", false, http.StatusUnauthorized},
+		{false, "/v1/processes", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, MetricsOptions{Auth: tt.auth, Listen: "127.0.0.1:0"})
+		for _, server := range []*http.Server{s.httpServer, s.metricsServer} {
+			want := tt.want
+			// The metrics address serves nothing but /metrics
+			if server == s.metricsServer && tt.path != "/metrics" && want == http.StatusOK {
+				want = http.StatusNotFound
+			}
+			if rec := get(server.Handler, tt.path, tt.token); rec.Code != want {
+				t.Errorf("%s GET %s (auth %v, token %v) = %d, want %d", server.Addr, tt.path, tt.auth, tt.token, rec.Code, want)
+			}
+		}
+	}
+}
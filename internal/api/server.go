@@ -1,12 +1,19 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Magnetkopf/Eternal/internal/config"
+	"github.com/Magnetkopf/Eternal/internal/logs"
 	"github.com/Magnetkopf/Eternal/internal/process"
 )
 
@@ -18,23 +25,78 @@ type Response struct {
 }
 
 type ProcessData struct {
-	Name   string `json:"name"`
-	PID    int    `json:"pid,omitempty"`
-	Status string `json:"status"`
+	Name       string `json:"name"`
+	PID        int    `json:"pid,omitempty"`
+	Status     string `json:"status"`
+	StopResult string `json:"stop_result,omitempty"`
+	// Health is starting, healthy or unhealthy for running services with a
+	// health check
+	Health string `json:"health,omitempty"`
+	// Limits are the effective resource limits of a running service as
+	// "soft:hard"
+	Limits map[string]string `json:"limits,omitempty"`
+	// Resources is the resource usage of a running service
+	Resources *ResourceData `json:"resources,omitempty"`
+}
+
+// ResourceData is the resource usage of a running service, summed over its
+// processes
+type ResourceData struct {
+	// CPUPercent is the CPU usage since the previous request, 100 is one
+	// busy CPU
+	CPUPercent float64 `json:"cpu_percent"`
+	CPUSeconds float64 `json:"cpu_seconds"`
+	// MemoryRSS is the resident memory in bytes
+	MemoryRSS uint64 `json:"memory_rss"`
+	Threads   int    `json:"threads"`
+	FDs       int    `json:"fds"`
+	Processes int    `json:"processes"`
+	// Uptime in seconds
+	Uptime float64 `json:"uptime"`
+}
+
+// RunData is one entry of the run history of a service
+type RunData struct {
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	// Duration in seconds
+	Duration float64 `json:"duration"`
+	// ExitCode is the exit status, 128+n after signal n, -1 if unknown
+	ExitCode int    `json:"exit_code"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
 }
 
 type ServiceListEntry struct {
 	Name    string `json:"name"`
 	Status  string `json:"status"`
 	Enabled bool   `json:"enabled"`
+	Health  string `json:"health,omitempty"`
+	// NextRun is the next scheduled start of services with a schedule
+	NextRun *time.Time `json:"next_run,omitempty"`
 }
 
 type CreateServiceRequest struct {
-	Exec string `json:"exec"`
-	Dir  string `json:"dir"`
+	Exec       string            `json:"exec"`
+	Args       []string          `json:"args,omitempty"`
+	Shell      bool              `json:"shell,omitempty"`
+	Dir        string            `json:"dir"`
+	Env        map[string]string `json:"env,omitempty"`
+	EnvFile    []string          `json:"env_file,omitempty"`
+	InheritEnv *bool             `json:"inherit_env,omitempty"`
+}
+
+// Server is the RESTful API server of the daemon
+type Server struct {
+	httpServer *http.Server
+	// metricsServer serves /metrics on its own address, if configured
+	metricsServer *http.Server
+	// cancel ends long-lived requests such as followed log streams
+	cancel context.CancelFunc
 }
 
-func StartServer(pm *process.Manager, port int, servicesDir, enabledFile, authToken string) {
+// NewServer creates the API server listening on 127.0.0.1:port
+func NewServer(pm *process.Manager, port int, servicesDir, enabledFile, authToken string, metrics MetricsOptions) *Server {
 	mux := http.NewServeMux()
 
 	// wrapper to inject dependencies
@@ -42,8 +104,12 @@ func StartServer(pm *process.Manager, port int, servicesDir, enabledFile, authTo
 		pm:          pm,
 		servicesDir: servicesDir,
 		enabledFile: enabledFile,
+		requests:    &requestCounter{},
 	}
 
+	// GET /metrics
+	mux.HandleFunc("GET /metrics", h.handleMetrics)
+
 	// GET /v1/processes
 	mux.HandleFunc("GET /v1/processes", h.handleList)
 
@@ -56,14 +122,22 @@ func StartServer(pm *process.Manager, port int, servicesDir, enabledFile, authTo
 	// PUT /v1/processes/:name
 	mux.HandleFunc("PUT /v1/processes/{name}", h.handleCreate)
 
+	// GET /v1/processes/:name/logs
+	mux.HandleFunc("GET /v1/processes/{name}/logs", h.handleLogs)
+
+	// GET /v1/processes/:name/runs
+	mux.HandleFunc("GET /v1/processes/{name}/runs", h.handleRuns)
+
 	// POST /v1/processes/:name/:action
 	mux.HandleFunc("POST /v1/processes/{name}/{action}", h.handleAction)
 
 	// Auth Middleware
 	authMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Prometheus may be allowed to scrape without the token
+			public := !metrics.Auth && r.URL.Path == "/metrics"
 			token := r.Header.Get("access-token")
-			if token != authToken {
+			if !public && token != authToken {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
@@ -71,18 +145,92 @@ func StartServer(pm *process.Manager, port int, servicesDir, enabledFile, authTo
 		})
 	}
 
-	addr := fmt.Sprintf("127.0.0.1:%d", port)
-	fmt.Printf("API Server listening on %s\n", addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		httpServer: &http.Server{
+			Addr:        fmt.Sprintf("127.0.0.1:%d", port),
+			Handler:     h.requests.countRequests(authMiddleware(mux)),
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		},
+		cancel: cancel,
+	}
 
-	if err := http.ListenAndServe(addr, authMiddleware(mux)); err != nil {
-		fmt.Printf("API Server failed: %v\n", err)
+	if metrics.Listen != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("GET /metrics", h.handleMetrics)
+		s.metricsServer = &http.Server{
+			Addr:    metrics.Listen,
+			Handler: h.requests.countRequests(authMiddleware(metricsMux)),
+		}
 	}
+	return s
+}
+
+// Listen opens the TCP listener of the API server
+func (s *Server) Listen() (net.Listener, error) {
+	return net.Listen("tcp", s.httpServer.Addr)
+}
+
+// ListenAndServe serves the API until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	l, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the API on l, which may be inherited from a previous daemon
+// instance, until Shutdown is called
+func (s *Server) Serve(l net.Listener) error {
+	fmt.Printf("API Server listening on %s\n", l.Addr())
+
+	err := s.httpServer.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// ListenMetrics opens the listener of the separate metrics address, nil if
+// none is configured
+func (s *Server) ListenMetrics() (net.Listener, error) {
+	if s.metricsServer == nil {
+		return nil, nil
+	}
+	return net.Listen("tcp", s.metricsServer.Addr)
+}
+
+// ServeMetrics serves /metrics on l, which may be inherited from a previous
+// daemon instance, until Shutdown is called
+func (s *Server) ServeMetrics(l net.Listener) error {
+	if s.metricsServer == nil {
+		return fmt.Errorf("no metrics address configured")
+	}
+	fmt.Printf("Metrics listening on %s\n", l.Addr())
+
+	err := s.metricsServer.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests and waits for running ones to finish
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+	if s.metricsServer != nil {
+		s.metricsServer.Shutdown(ctx)
+	}
+	return s.httpServer.Shutdown(ctx)
 }
 
 type handler struct {
 	pm          *process.Manager
 	servicesDir string
 	enabledFile string
+	// requests counts the API requests for /metrics
+	requests *requestCounter
 }
 
 func (h *handler) respondJSON(w http.ResponseWriter, code int, message string, data interface{}, errStr string) {
@@ -111,6 +259,8 @@ func (h *handler) respondSuccess(w http.ResponseWriter, message string, data int
 func (h *handler) handleList(w http.ResponseWriter, r *http.Request) {
 	// Get runtime status
 	statuses := h.pm.ListServices()
+	nextRuns := h.pm.NextRuns()
+	health := h.pm.HealthStatuses()
 
 	// Get enabled status
 	enabledList, err := config.LoadEnabledServices(h.enabledFile)
@@ -142,11 +292,16 @@ func (h *handler) handleList(w http.ResponseWriter, r *http.Request) {
 			statusStr = "not-found"
 		}
 
-		list = append(list, ServiceListEntry{
+		entry := ServiceListEntry{
 			Name:    name,
 			Status:  statusStr,
 			Enabled: enabledMap[name],
-		})
+			Health:  string(health[name]),
+		}
+		if next, ok := nextRuns[name]; ok {
+			entry.NextRun = &next
+		}
+		list = append(list, entry)
 	}
 
 	h.respondSuccess(w, "success", list)
@@ -163,6 +318,58 @@ func (h *handler) handleGet(w http.ResponseWriter, r *http.Request) {
 	data := ProcessData{
 		Name:   name,
 		Status: string(status),
+		Health: string(h.pm.Health(name)),
+	}
+	if stats, err := h.pm.Stats(name); err == nil && stats != nil {
+		data.PID = stats.PID
+		data.Resources = &ResourceData{
+			CPUPercent: stats.CPUPercent,
+			CPUSeconds: stats.CPUSeconds,
+			MemoryRSS:  stats.MemoryRSS,
+			Threads:    stats.Threads,
+			FDs:        stats.FDs,
+			Processes:  stats.Processes,
+			Uptime:     stats.Uptime.Seconds(),
+		}
+	}
+	if limits, err := h.pm.Limits(name); err == nil && len(limits) > 0 {
+		data.Limits = make(map[string]string)
+		for resource, limit := range limits {
+			data.Limits[resource] = limit.String()
+		}
+	}
+	h.respondSuccess(w, "success", data)
+}
+
+func (h *handler) handleRuns(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	runs, err := h.pm.Runs(name)
+	if err != nil {
+		h.respondError(w, 404, fmt.Sprintf("service '%s' not found", name))
+		return
+	}
+
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			h.respondError(w, 400, "invalid limit")
+			return
+		}
+		if limit > 0 && limit < len(runs) {
+			runs = runs[len(runs)-limit:]
+		}
+	}
+
+	data := make([]RunData, 0, len(runs))
+	for _, run := range runs {
+		data = append(data, RunData{
+			StartedAt: run.StartedAt,
+			EndedAt:   run.EndedAt,
+			Duration:  run.Duration().Seconds(),
+			ExitCode:  run.ExitCode,
+			Result:    string(run.Result),
+			Error:     run.Error,
+		})
 	}
 	h.respondSuccess(w, "success", data)
 }
@@ -173,17 +380,28 @@ func (h *handler) handleAction(w http.ResponseWriter, r *http.Request) {
 
 	var err error
 	var msg string
+	var stopResult process.StopResult
 
 	switch action {
 	case "start":
-		err = h.pm.StartService(name)
+		if r.URL.Query().Get("wait") == "true" {
+			err = h.pm.StartServiceWait(name)
+		} else {
+			err = h.pm.StartService(name)
+		}
 		msg = "process started successfully"
 	case "stop":
-		err = h.pm.StopService(name)
+		stopResult, err = h.pm.StopService(name)
 		msg = "process stopped successfully"
+		if stopResult == process.StopKilled {
+			msg = "process killed after stop timeout"
+		}
 	case "restart":
 		err = h.pm.RestartService(name)
 		msg = "process restarted successfully"
+	case "reset":
+		err = h.pm.ResetService(name)
+		msg = "process reset successfully"
 	case "enable":
 		err = config.EnableService(h.enabledFile, name)
 		msg = "service enabled"
@@ -204,8 +422,10 @@ func (h *handler) handleAction(w http.ResponseWriter, r *http.Request) {
 	status, _ := h.pm.GetStatus(name)
 
 	data := ProcessData{
-		Name:   name,
-		Status: string(status),
+		Name:       name,
+		PID:        h.pm.PID(name),
+		Status:     string(status),
+		StopResult: string(stopResult),
 	}
 
 	h.respondSuccess(w, msg, data)
@@ -220,14 +440,21 @@ func (h *handler) handleCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Exec == "" {
-		h.respondError(w, 400, "exec is required")
-		return
+	cfg := config.ServiceConfig{
+		Exec:       req.Exec,
+		Args:       req.Args,
+		Shell:      req.Shell,
+		Dir:        req.Dir,
+		Env:        req.Env,
+		EnvFile:    req.EnvFile,
+		InheritEnv: req.InheritEnv,
 	}
 
-	cfg := config.ServiceConfig{
-		Exec: req.Exec,
-		Dir:  req.Dir,
+	// Validate a copy, the defaults it fills in should not end up in the file
+	check := cfg
+	if err := check.Validate(); err != nil {
+		h.respondError(w, 400, err.Error())
+		return
 	}
 
 	serviceFile := filepath.Join(h.servicesDir, name+".yaml")
@@ -246,7 +473,7 @@ func (h *handler) handleDelete(w http.ResponseWriter, r *http.Request) {
 
 	// Stop if running
 	status, _ := h.pm.GetStatus(name)
-	if status == process.StatusRunning {
+	if status == process.StatusRunning || status == process.StatusStarting {
 		h.pm.StopService(name)
 	}
 
@@ -265,3 +492,74 @@ func (h *handler) handleDelete(w http.ResponseWriter, r *http.Request) {
 
 	h.respondSuccess(w, "service deleted", nil)
 }
+
+func (h *handler) handleLogs(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	query := r.URL.Query()
+
+	opts := logs.StreamOptions{Lines: 100}
+	if v := query.Get("lines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			h.respondError(w, 400, "invalid lines")
+			return
+		}
+		opts.Lines = n
+	}
+	if v := query.Get("follow"); v != "" {
+		follow, err := strconv.ParseBool(v)
+		if err != nil {
+			h.respondError(w, 400, "invalid follow")
+			return
+		}
+		opts.Follow = follow
+	}
+	since, err := logs.ParseSince(query.Get("since"), time.Now())
+	if err != nil {
+		h.respondError(w, 400, err.Error())
+		return
+	}
+	opts.Since = since
+
+	var stderr bool
+	switch query.Get("stream") {
+	case "", "stdout":
+	case "stderr":
+		stderr = true
+	default:
+		h.respondError(w, 400, "stream must be stdout or stderr")
+		return
+	}
+
+	if _, _, err := h.pm.LogPaths(name); err != nil {
+		h.respondError(w, 404, fmt.Sprintf("service '%s' not found", name))
+		return
+	}
+
+	// Server-sent events for browsers, plain chunked text otherwise
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(200)
+
+	flusher, _ := w.(http.Flusher)
+	err = h.pm.StreamLogs(r.Context(), name, stderr, opts, func(line []byte) error {
+		var err error
+		if sse {
+			_, err = fmt.Fprintf(w, "data: %s\n\n", line)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", line)
+		}
+		if err == nil && opts.Follow && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Failed to stream logs of %s: %v\n", name, err)
+	}
+}
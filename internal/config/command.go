@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Command returns the argv of the service process. Exactly one of exec and
+// args must be set; shell requires exec.
+func (c *ServiceConfig) Command() ([]string, error) {
+	switch {
+	case c.Exec == "" && len(c.Args) == 0:
+		return nil, fmt.Errorf("exec or args field is required")
+	case c.Exec != "" && len(c.Args) > 0:
+		return nil, fmt.Errorf("exec and args are mutually exclusive")
+	case c.Shell && c.Exec == "":
+		return nil, fmt.Errorf("shell requires exec")
+	case c.Shell:
+		return []string{"/bin/sh", "-c", c.Exec}, nil
+	case len(c.Args) > 0:
+		if c.Args[0] == "" {
+			return nil, fmt.Errorf("args must start with a program")
+		}
+		return c.Args, nil
+	}
+
+	argv, err := SplitCommand(c.Exec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exec: %w", err)
+	}
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("exec field is required")
+	}
+	return argv, nil
+}
+
+// SplitCommand splits a command line into words the way a POSIX shell does,
+// without expansions: words are separated by whitespace, single quotes keep
+// everything literally, double quotes allow \" \\ \$ and \` escapes, and a
+// backslash outside quotes escapes the next character.
+func SplitCommand(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
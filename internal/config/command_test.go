@@ -0,0 +1,103 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"sleep 100", []string{"sleep", "100"}},
+		{"  a \t b\nc  ", []string{"a", "b", "c"}},
+		{`python -c "print('hi there')"`, []string{"python", "-c", "print('hi there')"}},
+		{`echo 'say "hi"'`, []string{"echo", `say "hi"`}},
+		{`echo 'a\b'`, []string{"echo", `a\b`}},
+		{`echo "a \"b\" \\ \$HOME \` + "`" + `x\` + "`" + `"`, []string{"echo", `a "b" \ $HOME ` + "`x`"}},
+		// Other escapes stay as they are within double quotes
+		{`echo "a\nb"`, []string{"echo", `a\nb`}},
+		{`echo a\ b`, []string{"echo", "a b"}},
+		{`echo \"quoted\"`, []string{"echo", `"quoted"`}},
+		{`echo \'`, []string{"echo", "'"}},
+		{`a"b c"'d e'f`, []string{"ab cd ef"}},
+		{`echo "" ''`, []string{"echo", "", ""}},
+		{`echo ""`, []string{"echo", ""}},
+		{`--flag="a b"`, []string{"--flag=a b"}},
+	}
+	for _, tt := range tests {
+		got, err := SplitCommand(tt.in)
+		if err != nil {
+			t.Errorf("SplitCommand(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitCommand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSplitCommandErrors(t *testing.T) {
+	tests := []struct {
+		in, err string
+	}{
+		{`echo 'open`, "unterminated single quote"},
+		{`echo "open`, "unterminated double quote"},
+		{`echo "open\"`, "unterminated double quote"},
+		{`echo \`, "trailing backslash"},
+	}
+	for _, tt := range tests {
+		_, err := SplitCommand(tt.in)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("SplitCommand(%q) error = %v, want %q", tt.in, err, tt.err)
+		}
+	}
+}
+
+func TestLoadConfigCommand(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want []string
+		err  string
+	}{
+		{yaml: `exec: python -c "print('hi there')"`, want: []string{"python", "-c", "print('hi there')"}},
+		{yaml: "args: [python, -c, \"print('hi there')\"]", want: []string{"python", "-c", "print('hi there')"}},
+		{yaml: "exec: echo $HOME | wc -c\nshell: true", want: []string{"/bin/sh", "-c", "echo $HOME | wc -c"}},
+		{yaml: "dir: /tmp", err: "exec or args field is required"},
+		{yaml: "exec: sleep 1\nargs: [sleep, \"1\"]", err: "mutually exclusive"},
+		{yaml: "args: [sleep, \"1\"]\nshell: true", err: "shell requires exec"},
+		{yaml: `args: ["", "1"]`, err: "args must start with a program"},
+		{yaml: `exec: echo "open`, err: "unterminated double quote"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "service.yaml")
+		if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("LoadConfig(%q) error = %v, want %q", tt.yaml, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("LoadConfig(%q): %v", tt.yaml, err)
+			continue
+		}
+		got, err := cfg.Command()
+		if err != nil {
+			t.Errorf("LoadConfig(%q).Command(): %v", tt.yaml, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LoadConfig(%q).Command() = %q, want %q", tt.yaml, got, tt.want)
+		}
+	}
+}
@@ -6,19 +6,265 @@ import (
 	"math/big"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/Magnetkopf/Eternal/internal/schedule"
 	"gopkg.in/yaml.v3"
 )
 
+// RestartPolicy controls what happens when a service exits on its own
+type RestartPolicy string
+
+const (
+	RestartNo            RestartPolicy = "no"
+	RestartAlways        RestartPolicy = "always"
+	RestartOnFailure     RestartPolicy = "on-failure"
+	RestartUnlessStopped RestartPolicy = "unless-stopped"
+)
+
+// KillMode selects which processes receive stop signals
+type KillMode string
+
+const (
+	// KillProcess signals only the main process
+	KillProcess KillMode = "process"
+	// KillGroup signals the process group of the service
+	KillGroup KillMode = "group"
+	// KillTree signals the process group and every descendant of the main
+	// process, including those that moved to another group or session
+	KillTree KillMode = "tree"
+)
+
+// ServiceType describes how the process of a service behaves on start
+type ServiceType string
+
+const (
+	// ServiceSimple services keep running in the process that was started
+	ServiceSimple ServiceType = "simple"
+	// ServiceForking services fork into the background and exit, the main
+	// process is read from PIDFile
+	ServiceForking ServiceType = "forking"
+	// ServiceOneshot services run to completion, a clean exit is a success
+	ServiceOneshot ServiceType = "oneshot"
+)
+
+// ConcurrencyPolicy decides what a scheduled run does while the previous run
+// is still going
+type ConcurrencyPolicy string
+
+const (
+	// ConcurrencySkip drops the new run
+	ConcurrencySkip ConcurrencyPolicy = "skip"
+	// ConcurrencyQueue starts the new run once the previous one exits
+	ConcurrencyQueue ConcurrencyPolicy = "queue"
+	// ConcurrencyReplace stops the previous run and starts the new one
+	ConcurrencyReplace ConcurrencyPolicy = "replace"
+)
+
+// Defaults for the restart tuning fields of ServiceConfig
+const (
+	DefaultRestartDelay       = time.Second
+	DefaultRestartBackoffMax  = 30 * time.Second
+	DefaultStartLimitBurst    = 5
+	DefaultStartLimitInterval = time.Minute
+	DefaultStopSignal         = "SIGTERM"
+	DefaultStopTimeout        = 10 * time.Second
+)
+
+// signals lists the signals accepted by stop_signal
+var signals = map[string]syscall.Signal{
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGKILL":  syscall.SIGKILL,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGABRT":  syscall.SIGABRT,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+// ParseSignal converts a signal name such as "SIGTERM" or "term" to a signal
+func ParseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signals[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal: %s", name)
+	}
+	return sig, nil
+}
+
 // ServiceConfig represents the configuration for a service
 type ServiceConfig struct {
-	Exec string `yaml:"exec"`
-	Dir  string `yaml:"dir"`
+	Exec    string        `yaml:"exec"`
+	Dir     string        `yaml:"dir"`
+	Restart RestartPolicy `yaml:"restart,omitempty"`
+	Type    ServiceType   `yaml:"type,omitempty"`
+	// File the main process of a forking service writes its PID to,
+	// relative paths are resolved against Dir
+	PIDFile string `yaml:"pid_file,omitempty"`
+
+	// Services started along with this one, which fails if they cannot start
+	Requires []string `yaml:"requires,omitempty"`
+	// Services started along with this one, their failure is ignored
+	Wants []string `yaml:"wants,omitempty"`
+	// Services that start before this one when both are started together
+	After []string `yaml:"after,omitempty"`
+
+	// Cron expression or @every interval to start the service at
+	Schedule          string            `yaml:"schedule,omitempty"`
+	ConcurrencyPolicy ConcurrencyPolicy `yaml:"concurrency_policy,omitempty"`
+
+	// Probe that tells whether the running service is healthy
+	HealthCheck *HealthCheck `yaml:"healthcheck,omitempty"`
+	// Condition that moves a started service from starting to running
+	Ready *Readiness `yaml:"ready,omitempty"`
+	// Services not ready (oneshot: not finished) in time are stopped and
+	// count as failed
+	StartTimeout time.Duration `yaml:"start_timeout,omitempty"`
+	// Seconds within which a running service must send WATCHDOG=1 to its
+	// notify socket, 0 disables the watchdog
+	WatchdogSec int `yaml:"watchdog_sec,omitempty"`
+
+	// Delay before the first automatic restart, doubled on every consecutive one
+	RestartDelay time.Duration `yaml:"restart_delay,omitempty"`
+	// Upper bound for the exponential restart delay
+	RestartBackoffMax time.Duration `yaml:"restart_backoff_max,omitempty"`
+	// At most StartLimitBurst starts within StartLimitInterval before the
+	// service is considered to be crash-looping
+	StartLimitBurst    int           `yaml:"start_limit_burst,omitempty"`
+	StartLimitInterval time.Duration `yaml:"start_limit_interval,omitempty"`
+
+	// Signal sent by StopService, SIGKILL follows after StopTimeout
+	StopSignal  string        `yaml:"stop_signal,omitempty"`
+	StopTimeout time.Duration `yaml:"stop_timeout,omitempty"`
+	KillMode    KillMode      `yaml:"kill_mode,omitempty"`
+
+	// Log files for captured output, relative paths are resolved against
+	// ~/.eternal/logs. Pointing both at the same file produces a combined log.
+	StdoutLog string `yaml:"stdout_log,omitempty"`
+	StderrLog string `yaml:"stderr_log,omitempty"`
+
+	// Rotation settings, unset fields fall back to the system configuration
+	LogConfig `yaml:",inline"`
+
+	// Alternative to Exec: the program and its arguments, used verbatim
+	Args []string `yaml:"args,omitempty"`
+	// Run Exec through /bin/sh -c
+	Shell bool `yaml:"shell,omitempty"`
+
+	// Extra environment variables, taking precedence over env files
+	Env map[string]string `yaml:"env,omitempty"`
+	// Dotenv files loaded at start, relative paths are resolved against Dir
+	EnvFile []string `yaml:"env_file,omitempty"`
+	// Whether the daemon's environment is passed on, defaults to true
+	InheritEnv *bool `yaml:"inherit_env,omitempty"`
+
+	// Account the process runs as, names or numeric IDs
+	User   string   `yaml:"user,omitempty"`
+	Group  string   `yaml:"group,omitempty"`
+	Groups []string `yaml:"groups,omitempty"`
+
+	// Resource limits of the process
+	Limits *Limits `yaml:"limits,omitempty"`
+
+	// cgroup v2 resource control, applied when the daemon has a delegated
+	// cgroup. Unset fields leave the resource unrestricted.
+	MemoryMax  ByteSize `yaml:"memory_max,omitempty"`
+	MemoryHigh ByteSize `yaml:"memory_high,omitempty"`
+	CPUWeight  int      `yaml:"cpu_weight,omitempty"`
+	// CPU time as a percentage of one CPU, such as "150%"
+	CPUMax   string `yaml:"cpu_max,omitempty"`
+	PidsMax  int    `yaml:"pids_max,omitempty"`
+	IOWeight int    `yaml:"io_weight,omitempty"`
+}
+
+// Defaults for log rotation
+const (
+	DefaultLogMaxSize  ByteSize = 10 << 20
+	DefaultLogMaxFiles          = 5
+	DefaultAPIPort              = 9093
+)
+
+// LogConfig controls rotation of captured service logs
+type LogConfig struct {
+	// Rotate once the active file would grow beyond this size
+	LogMaxSize ByteSize `yaml:"log_max_size,omitempty"`
+	// Number of rotated files to keep
+	LogMaxFiles int `yaml:"log_max_files,omitempty"`
+	// Rotate once the active file is older than this, 0 disables
+	LogMaxAge time.Duration `yaml:"log_max_age,omitempty"`
+	// Gzip rotated files
+	LogCompress *bool `yaml:"log_compress,omitempty"`
+}
+
+// Merge returns c with unset fields taken from defaults
+func (c LogConfig) Merge(defaults LogConfig) LogConfig {
+	if c.LogMaxSize == 0 {
+		c.LogMaxSize = defaults.LogMaxSize
+	}
+	if c.LogMaxFiles == 0 {
+		c.LogMaxFiles = defaults.LogMaxFiles
+	}
+	if c.LogMaxAge == 0 {
+		c.LogMaxAge = defaults.LogMaxAge
+	}
+	if c.LogCompress == nil {
+		c.LogCompress = defaults.LogCompress
+	}
+	return c
+}
+
+func (c LogConfig) validate() error {
+	if c.LogMaxSize < 0 || c.LogMaxFiles < 0 || c.LogMaxAge < 0 {
+		return fmt.Errorf("log rotation settings must not be negative")
+	}
+	return nil
 }
 
+// ShutdownMode selects what happens to services when the daemon exits
+type ShutdownMode string
+
+const (
+	// ShutdownStop stops every service gracefully
+	ShutdownStop ShutdownMode = "stop"
+	// ShutdownDetach leaves services running
+	ShutdownDetach ShutdownMode = "detach"
+	// ShutdownKill kills every service with SIGKILL
+	ShutdownKill ShutdownMode = "kill"
+)
+
+// DefaultShutdownTimeout bounds how long stopping all services may take
+const DefaultShutdownTimeout = time.Minute
+
 type SystemConfig struct {
 	Token   string `yaml:"token"`
 	APIPort int    `yaml:"api_port"`
+
+	// What to do with running services when the daemon shuts down
+	ShutdownMode ShutdownMode `yaml:"shutdown_mode,omitempty"`
+	// Services still running after this are killed
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout,omitempty"`
+
+	// Init enables container init mode, which is always on when the daemon
+	// runs as PID 1
+	Init bool `yaml:"init,omitempty"`
+	// Primary is the service whose exit ends the daemon in init mode
+	Primary string `yaml:"primary,omitempty"`
+
+	// MetricsListen is a separate address serving /metrics, such as
+	// "0.0.0.0:9100". Empty serves it on the API port only.
+	MetricsListen string `yaml:"metrics_listen,omitempty"`
+	// MetricsAuth requires the access token for /metrics, defaults to true
+	MetricsAuth *bool `yaml:"metrics_auth,omitempty"`
+
+	// Log rotation defaults for all services
+	LogConfig `yaml:",inline"`
 }
 
 // LoadConfig loads a service configuration from a YAML file
@@ -33,52 +279,215 @@ func LoadConfig(path string) (*ServiceConfig, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
-	// Basic validation
-	if cfg.Exec == "" {
-		return nil, fmt.Errorf("exec field is required")
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
 	return &cfg, nil
 }
 
+// Validate checks a service configuration and fills in defaults for unset fields
+func (c *ServiceConfig) Validate() error {
+	if _, err := c.Command(); err != nil {
+		return err
+	}
+
+	switch c.Restart {
+	case "", RestartNo, RestartAlways, RestartOnFailure, RestartUnlessStopped:
+	default:
+		return fmt.Errorf("invalid restart policy: %s", c.Restart)
+	}
+
+	if c.RestartDelay < 0 || c.RestartBackoffMax < 0 || c.StartLimitInterval < 0 {
+		return fmt.Errorf("restart durations must not be negative")
+	}
+	if c.StartLimitBurst < 0 {
+		return fmt.Errorf("start_limit_burst must not be negative")
+	}
+
+	if c.RestartDelay == 0 {
+		c.RestartDelay = DefaultRestartDelay
+	}
+	if c.RestartBackoffMax == 0 {
+		c.RestartBackoffMax = DefaultRestartBackoffMax
+	}
+	if c.RestartBackoffMax < c.RestartDelay {
+		c.RestartBackoffMax = c.RestartDelay
+	}
+	if c.StartLimitBurst == 0 {
+		c.StartLimitBurst = DefaultStartLimitBurst
+	}
+	if c.StartLimitInterval == 0 {
+		c.StartLimitInterval = DefaultStartLimitInterval
+	}
+
+	if c.StopSignal == "" {
+		c.StopSignal = DefaultStopSignal
+	}
+	if _, err := ParseSignal(c.StopSignal); err != nil {
+		return fmt.Errorf("invalid stop_signal: %w", err)
+	}
+	if c.StopTimeout < 0 {
+		return fmt.Errorf("stop_timeout must not be negative")
+	}
+	if c.StopTimeout == 0 {
+		c.StopTimeout = DefaultStopTimeout
+	}
+
+	switch c.Type {
+	case "":
+		c.Type = ServiceSimple
+	case ServiceSimple, ServiceOneshot:
+	case ServiceForking:
+		if c.PIDFile == "" {
+			return fmt.Errorf("pid_file is required for type: forking")
+		}
+	default:
+		return fmt.Errorf("invalid type: %s", c.Type)
+	}
+
+	if c.Schedule != "" {
+		if _, err := schedule.Parse(c.Schedule); err != nil {
+			return err
+		}
+	}
+	switch c.ConcurrencyPolicy {
+	case "":
+		c.ConcurrencyPolicy = ConcurrencySkip
+	case ConcurrencySkip, ConcurrencyQueue, ConcurrencyReplace:
+	default:
+		return fmt.Errorf("invalid concurrency_policy: %s", c.ConcurrencyPolicy)
+	}
+
+	if c.HealthCheck != nil {
+		if err := c.HealthCheck.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Ready != nil {
+		if err := c.Ready.validate(c); err != nil {
+			return err
+		}
+	}
+	if c.StartTimeout < 0 {
+		return fmt.Errorf("start_timeout must not be negative")
+	}
+	if c.WatchdogSec < 0 {
+		return fmt.Errorf("watchdog_sec must not be negative")
+	}
+	// Oneshot services may run as long as they need unless told otherwise
+	if c.StartTimeout == 0 && c.Type != ServiceOneshot {
+		c.StartTimeout = DefaultStartTimeout
+	}
+
+	switch c.KillMode {
+	case "":
+		c.KillMode = KillGroup
+	case KillProcess, KillGroup, KillTree:
+	default:
+		return fmt.Errorf("invalid kill_mode: %s", c.KillMode)
+	}
+
+	if err := c.LogConfig.validate(); err != nil {
+		return err
+	}
+
+	for key := range c.Env {
+		if !validEnvKey(key) {
+			return fmt.Errorf("invalid env variable name: %q", key)
+		}
+	}
+
+	if _, err := c.Credential(); err != nil {
+		return err
+	}
+
+	if c.Limits != nil {
+		if err := c.Limits.validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.validateResources(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// PIDFilePath returns the path of PIDFile, resolved against Dir
+func (c *ServiceConfig) PIDFilePath() string {
+	if c.PIDFile == "" || filepath.IsAbs(c.PIDFile) {
+		return c.PIDFile
+	}
+	return filepath.Join(c.Dir, c.PIDFile)
+}
+
 // LoadEnabledServices loads the list of enabled services from the given file
 func LoadEnabledServices(path string) ([]string, error) {
+	return loadServiceList(path)
+}
+
+// LoadStoppedServices loads the list of services explicitly stopped by the user
+func LoadStoppedServices(path string) ([]string, error) {
+	return loadServiceList(path)
+}
+
+// EnableService adds a service to the enabled list
+func EnableService(path, name string) error {
+	return addToServiceList(path, name)
+}
+
+// DisableService removes a service from the enabled list
+func DisableService(path, name string) error {
+	return removeFromServiceList(path, name)
+}
+
+// MarkServiceStopped records that a service was stopped by the user
+func MarkServiceStopped(path, name string) error {
+	return addToServiceList(path, name)
+}
+
+// UnmarkServiceStopped clears the user-stopped record of a service
+func UnmarkServiceStopped(path, name string) error {
+	return removeFromServiceList(path, name)
+}
+
+func loadServiceList(path string) ([]string, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return []string{}, nil
 		}
-		return nil, fmt.Errorf("failed to read enabled services: %w", err)
+		return nil, fmt.Errorf("failed to read service list: %w", err)
 	}
 
 	var services []string
 	if err := yaml.Unmarshal(data, &services); err != nil {
-		return nil, fmt.Errorf("failed to parse enabled services: %w", err)
+		return nil, fmt.Errorf("failed to parse service list: %w", err)
 	}
 
 	return services, nil
 }
 
-// EnableService adds a service to the enabled list
-func EnableService(path, name string) error {
-	services, err := LoadEnabledServices(path)
+func addToServiceList(path, name string) error {
+	services, err := loadServiceList(path)
 	if err != nil {
 		return err
 	}
 
 	for _, s := range services {
 		if s == name {
-			return nil // Already enabled
+			return nil // Already listed
 		}
 	}
 
 	services = append(services, name)
-	return saveEnabledServices(path, services)
+	return saveServiceList(path, services)
 }
 
-// DisableService removes a service from the enabled list
-func DisableService(path, name string) error {
-	services, err := LoadEnabledServices(path)
+func removeFromServiceList(path, name string) error {
+	services, err := loadServiceList(path)
 	if err != nil {
 		return err
 	}
@@ -94,13 +503,13 @@ func DisableService(path, name string) error {
 		return nil // Not found, nothing to do
 	}
 
-	return saveEnabledServices(path, newServices)
+	return saveServiceList(path, newServices)
 }
 
-func saveEnabledServices(path string, services []string) error {
+func saveServiceList(path string, services []string) error {
 	data, err := yaml.Marshal(services)
 	if err != nil {
-		return fmt.Errorf("failed to marshal enabled services: %w", err)
+		return fmt.Errorf("failed to marshal service list: %w", err)
 	}
 
 	// Ensure directory exists
@@ -110,7 +519,7 @@ func saveEnabledServices(path string, services []string) error {
 	}
 
 	if err := os.WriteFile(path, data, 0644); err != nil {
-		return fmt.Errorf("failed to write enabled services: %w", err)
+		return fmt.Errorf("failed to write service list: %w", err)
 	}
 	return nil
 }
@@ -153,19 +562,32 @@ func LoadOrGenerateSystemConfig(path string) (SystemConfig, error) {
 	// Try to read existing
 	data, err := os.ReadFile(path)
 	if err == nil {
-		// config exists
+		// config exists, never overwrite it because of a mistake in it
 		var cfg SystemConfig
-		if err := yaml.Unmarshal(data, &cfg); err == nil {
-
-			return cfg, nil
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return SystemConfig{}, fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+		if cfg.APIPort == 0 {
+			cfg.APIPort = DefaultAPIPort
 		}
+		if err := cfg.applyShutdownDefaults(); err != nil {
+			return SystemConfig{}, err
+		}
+		if err := cfg.LogConfig.validate(); err != nil {
+			return SystemConfig{}, err
+		}
+		cfg.LogConfig = cfg.LogConfig.Merge(LogConfig{
+			LogMaxSize:  DefaultLogMaxSize,
+			LogMaxFiles: DefaultLogMaxFiles,
+		})
+		return cfg, nil
 	} else if !os.IsNotExist(err) {
 		return SystemConfig{}, fmt.Errorf("failed to read config: %w", err)
 	}
 
 	// Generate new config
 	token := generateRandomString(20)
-	cfg := SystemConfig{Token: token, APIPort: 9093}
+	cfg := SystemConfig{Token: token, APIPort: DefaultAPIPort}
 
 	data, err = yaml.Marshal(cfg)
 	if err != nil {
@@ -181,9 +603,35 @@ func LoadOrGenerateSystemConfig(path string) (SystemConfig, error) {
 		return SystemConfig{}, fmt.Errorf("failed to write config: %w", err)
 	}
 
+	cfg.LogMaxSize = DefaultLogMaxSize
+	cfg.LogMaxFiles = DefaultLogMaxFiles
+	cfg.applyShutdownDefaults()
 	return cfg, nil
 }
 
+// MetricsAuthRequired reports whether /metrics requires the access token
+func (c *SystemConfig) MetricsAuthRequired() bool {
+	return c.MetricsAuth == nil || *c.MetricsAuth
+}
+
+func (c *SystemConfig) applyShutdownDefaults() error {
+	switch c.ShutdownMode {
+	case "":
+		c.ShutdownMode = ShutdownStop
+	case ShutdownStop, ShutdownDetach, ShutdownKill:
+	default:
+		return fmt.Errorf("invalid shutdown_mode: %s", c.ShutdownMode)
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout must not be negative")
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	return nil
+}
+
 func generateRandomString(n int) string {
 	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	ret := make([]byte, n)
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadOrGenerateSystemConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eternal", "config.yaml")
+
+	// A missing file is generated
+	cfg, err := LoadOrGenerateSystemConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Token == "" || cfg.APIPort != DefaultAPIPort {
+		t.Errorf("generated config = %+v, want a token and port %d", cfg, DefaultAPIPort)
+	}
+	again, err := LoadOrGenerateSystemConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Token != cfg.Token {
+		t.Errorf("token changed from %q to %q", cfg.Token, again.Token)
+	}
+
+	// An existing file is used as it is
+	content := "token: mytoken\napi_port: 19098\nshutdown_timeout: 30s\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = LoadOrGenerateSystemConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Token != "mytoken" || cfg.APIPort != 19098 || cfg.ShutdownTimeout != 30*time.Second {
+		t.Errorf("config = %+v, want the one in the file", cfg)
+	}
+}
+
+func TestLoadOrGenerateSystemConfigErrors(t *testing.T) {
+	tests := []struct {
+		content, err string
+	}{
+		// A bare number is not a duration
+		{"token: mytoken\napi_port: 19098\nshutdown_timeout: 30\n", "failed to parse config"},
+		{"token: [mytoken\n", "failed to parse config"},
+		{"token: mytoken\nshutdown_timeout: -1s\n", "shutdown_timeout must not be negative"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadOrGenerateSystemConfig(path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("LoadOrGenerateSystemConfig(%q) error = %v, want %q", tt.content, err, tt.err)
+		}
+		// The file is left for the user to fix
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != tt.content {
+			t.Errorf("config %q was changed to %q", tt.content, data)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Credential resolves user, group and groups to the IDs the service process
+// runs with. It returns nil when none of them is set. Without an explicit
+// group the user's primary group is used, and without explicit groups the
+// user's supplementary groups. A numeric user without a passwd entry has
+// neither, the daemon's group is used instead.
+func (c *ServiceConfig) Credential() (*syscall.Credential, error) {
+	if c.User == "" && c.Group == "" && len(c.Groups) == 0 {
+		return nil, nil
+	}
+
+	cred := &syscall.Credential{
+		Uid: uint32(syscall.Getuid()),
+		Gid: uint32(syscall.Getgid()),
+	}
+
+	var u *user.User
+	if c.User != "" {
+		var err error
+		u, err = lookupUser(c.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		cred.Uid = uint32(uid)
+		if gid, err := strconv.ParseUint(u.Gid, 10, 32); err == nil {
+			cred.Gid = uint32(gid)
+		}
+	}
+
+	if c.Group != "" {
+		gid, err := lookupGroup(c.Group)
+		if err != nil {
+			return nil, err
+		}
+		cred.Gid = gid
+	}
+
+	if len(c.Groups) > 0 {
+		for _, name := range c.Groups {
+			gid, err := lookupGroup(name)
+			if err != nil {
+				return nil, err
+			}
+			cred.Groups = append(cred.Groups, gid)
+		}
+	} else if u != nil && u.Username != "" {
+		ids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up groups of user %s: %w", c.User, err)
+		}
+		for _, id := range ids {
+			gid, err := strconv.ParseUint(id, 10, 32)
+			if err == nil && uint32(gid) != cred.Gid {
+				cred.Groups = append(cred.Groups, uint32(gid))
+			}
+		}
+	}
+
+	return cred, nil
+}
+
+// lookupUser resolves a user name or numeric ID. A numeric ID without a
+// passwd entry, common in containers, yields a user with only Uid set.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		if u, err := user.Lookup(name); err == nil {
+			return u, nil
+		}
+		return &user.User{Uid: name}, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user: %s", name)
+	}
+	return u, nil
+}
+
+// lookupGroup resolves a group name or numeric ID
+func lookupGroup(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group: %s", name)
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid gid for group %s: %s", name, g.Gid)
+	}
+	return uint32(id), nil
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCredential(t *testing.T) {
+	daemonGID := uint32(syscall.Getgid())
+	tests := []struct {
+		user, group string
+		groups      []string
+		uid, gid    uint32
+		err         string
+	}{
+		{user: "root", uid: 0, gid: 0},
+		{user: "0", uid: 0, gid: 0},
+		{user: "0", group: "100", uid: 0, gid: 100},
+		// No passwd entry: the daemon's group unless group is set
+		{user: "4242", uid: 4242, gid: daemonGID},
+		{user: "4242", group: "4243", groups: []string{"5000"}, uid: 4242, gid: 4243},
+		{user: "no-such-user", err: "unknown user: no-such-user"},
+		{user: "4242", group: "no-such-group", err: "unknown group: no-such-group"},
+	}
+	for _, tt := range tests {
+		cfg := &ServiceConfig{User: tt.user, Group: tt.group, Groups: tt.groups}
+		cred, err := cfg.Credential()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Credential(%s:%s) error = %v, want %q", tt.user, tt.group, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Credential(%s:%s): %v", tt.user, tt.group, err)
+			continue
+		}
+		if cred.Uid != tt.uid || cred.Gid != tt.gid {
+			t.Errorf("Credential(%s:%s) = %d:%d, want %d:%d", tt.user, tt.group, cred.Uid, cred.Gid, tt.uid, tt.gid)
+		}
+		if tt.groups != nil && (len(cred.Groups) != 1 || cred.Groups[0] != 5000) {
+			t.Errorf("Credential(%s:%s) groups = %v, want [5000]", tt.user, tt.group, cred.Groups)
+		}
+		if tt.user == "4242" && tt.groups == nil && len(cred.Groups) != 0 {
+			t.Errorf("Credential(%s) groups = %v, want none", tt.user, cred.Groups)
+		}
+	}
+}
+
+func TestEnvironmentUser(t *testing.T) {
+	t.Setenv("HOME", "/home/daemon")
+	t.Setenv("USER", "daemon")
+	t.Setenv("LOGNAME", "daemon")
+
+	tests := []struct {
+		user, home, name string
+	}{
+		{"root", "/root", "root"},
+		// Without a passwd entry the daemon's values are kept
+		{"4242", "/home/daemon", "daemon"},
+	}
+	for _, tt := range tests {
+		env, err := (&ServiceConfig{User: tt.user}).Environment()
+		if err != nil {
+			t.Errorf("Environment(%s): %v", tt.user, err)
+			continue
+		}
+		got := envMap(t, env)
+		if got["HOME"] != tt.home || got["USER"] != tt.name || got["LOGNAME"] != tt.name {
+			t.Errorf("Environment(%s) HOME=%q USER=%q LOGNAME=%q, want %q and %q", tt.user, got["HOME"], got["USER"], got["LOGNAME"], tt.home, tt.name)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DependencyGraph relates services through their requires, wants and after
+// fields. Requires and wants pull services in, requires and after order them.
+type DependencyGraph struct {
+	services map[string]*ServiceConfig
+}
+
+// NewDependencyGraph builds the graph of the given services and checks the
+// start order for cycles. Services named in after that are not part of the
+// set are ignored, missing requirements are reported when they are needed.
+func NewDependencyGraph(services map[string]*ServiceConfig) (*DependencyGraph, error) {
+	g := &DependencyGraph{services: services}
+	if cycle := g.findCycle(); cycle != nil {
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return g, nil
+}
+
+// orderedAfter returns the services that start before name, when both are
+// started together. Requirements are implicitly ordered first.
+func (g *DependencyGraph) orderedAfter(name string) []string {
+	cfg, ok := g.services[name]
+	if !ok {
+		return nil
+	}
+	var deps []string
+	for _, dep := range append(append([]string{}, cfg.Requires...), cfg.After...) {
+		if _, ok := g.services[dep]; ok {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
+// findCycle returns the services forming a cycle in the start order, with
+// the first one repeated at the end, or nil
+func (g *DependencyGraph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					return append(append([]string{}, path[i:]...), name)
+				}
+			}
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range g.orderedAfter(name) {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		return nil
+	}
+
+	for _, name := range sortedNames(g.services) {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// Closure returns name along with everything it requires or wants,
+// recursively. A missing required service is an error, a missing wanted one
+// is skipped.
+func (g *DependencyGraph) Closure(name string) ([]string, error) {
+	if _, ok := g.services[name]; !ok {
+		return nil, fmt.Errorf("service %s not found", name)
+	}
+
+	seen := map[string]bool{name: true}
+	result := []string{name}
+	for i := 0; i < len(result); i++ {
+		cfg := g.services[result[i]]
+		for _, dep := range cfg.Requires {
+			if _, ok := g.services[dep]; !ok {
+				return nil, fmt.Errorf("service %s requires %s, which does not exist", result[i], dep)
+			}
+			if !seen[dep] {
+				seen[dep] = true
+				result = append(result, dep)
+			}
+		}
+		for _, dep := range cfg.Wants {
+			if _, ok := g.services[dep]; ok && !seen[dep] {
+				seen[dep] = true
+				result = append(result, dep)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Before returns the services among names that name is ordered after
+func (g *DependencyGraph) Before(name string, names []string) []string {
+	var before []string
+	for _, dep := range g.orderedAfter(name) {
+		for _, n := range names {
+			if n == dep {
+				before = append(before, dep)
+				break
+			}
+		}
+	}
+	return before
+}
+
+// Requires returns the services name requires
+func (g *DependencyGraph) Requires(name string) []string {
+	if cfg, ok := g.services[name]; ok {
+		return cfg.Requires
+	}
+	return nil
+}
+
+// Levels groups names into batches that can be started in parallel: every
+// service is ordered after services of earlier batches only. Ordering with
+// services outside of names is ignored.
+func (g *DependencyGraph) Levels(names []string) [][]string {
+	include := make(map[string]bool)
+	for _, name := range names {
+		include[name] = true
+	}
+
+	level := make(map[string]int)
+	var depth func(name string) int
+	depth = func(name string) int {
+		if l, ok := level[name]; ok {
+			return l
+		}
+		l := 0
+		for _, dep := range g.orderedAfter(name) {
+			if include[dep] {
+				if d := depth(dep) + 1; d > l {
+					l = d
+				}
+			}
+		}
+		level[name] = l
+		return l
+	}
+
+	var levels [][]string
+	for name := range include {
+		l := depth(name)
+		for len(levels) <= l {
+			levels = append(levels, nil)
+		}
+		levels[l] = append(levels[l], name)
+	}
+	for _, batch := range levels {
+		sort.Strings(batch)
+	}
+	return levels
+}
+
+func sortedNames(services map[string]*ServiceConfig) []string {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
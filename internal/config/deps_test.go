@@ -0,0 +1,171 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDependencyCycles(t *testing.T) {
+	tests := []struct {
+		name     string
+		services map[string]*ServiceConfig
+		cycle    string
+	}{
+		{
+			name: "two services",
+			services: map[string]*ServiceConfig{
+				"a": {Requires: []string{"b"}},
+				"b": {After: []string{"a"}},
+			},
+			cycle: "a -> b -> a",
+		},
+		{
+			name: "three services",
+			services: map[string]*ServiceConfig{
+				"a": {Requires: []string{"b"}},
+				"b": {Requires: []string{"c"}},
+				"c": {After: []string{"a"}},
+				"d": {Requires: []string{"a"}},
+			},
+			cycle: "a -> b -> c -> a",
+		},
+		{
+			name: "self",
+			services: map[string]*ServiceConfig{
+				"a": {After: []string{"a"}},
+			},
+			cycle: "a -> a",
+		},
+	}
+	for _, tt := range tests {
+		_, err := NewDependencyGraph(tt.services)
+		if err == nil {
+			t.Errorf("%s: no cycle reported", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), "dependency cycle: "+tt.cycle) {
+			t.Errorf("%s: error = %v, want cycle %s", tt.name, err, tt.cycle)
+		}
+	}
+
+	// Wants does not order, so it cannot form a cycle
+	_, err := NewDependencyGraph(map[string]*ServiceConfig{
+		"a": {Wants: []string{"b"}},
+		"b": {Wants: []string{"a"}},
+	})
+	if err != nil {
+		t.Errorf("wants cycle: %v", err)
+	}
+}
+
+func TestDependencyClosure(t *testing.T) {
+	g, err := NewDependencyGraph(map[string]*ServiceConfig{
+		"web":     {Requires: []string{"db"}, Wants: []string{"cache", "missing"}, After: []string{"migrate", "gone"}},
+		"db":      {},
+		"cache":   {},
+		"migrate": {},
+		"broken":  {Requires: []string{"missing"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want []string
+		err  string
+	}{
+		// after neither pulls migrate in nor fails on the unknown gone, and a
+		// missing wanted service is skipped
+		{name: "web", want: []string{"web", "db", "cache"}},
+		{name: "db", want: []string{"db"}},
+		{name: "broken", err: "service broken requires missing, which does not exist"},
+		{name: "nope", err: "service nope not found"},
+	}
+	for _, tt := range tests {
+		got, err := g.Closure(tt.name)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("Closure(%s) error = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Closure(%s): %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Closure(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDependencyLevels(t *testing.T) {
+	g, err := NewDependencyGraph(map[string]*ServiceConfig{
+		// A diamond: top needs left and right, which both need base
+		"top":   {Requires: []string{"left", "right"}},
+		"left":  {Requires: []string{"base"}},
+		"right": {Wants: []string{"base"}, After: []string{"base"}},
+		"base":  {},
+		// Ordered after left without requiring it
+		"late": {After: []string{"left"}},
+		"solo": {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		names []string
+		want  [][]string
+	}{
+		{
+			names: []string{"top", "left", "right", "base", "solo"},
+			want:  [][]string{{"base", "solo"}, {"left", "right"}, {"top"}},
+		},
+		{
+			names: []string{"late", "left", "base"},
+			want:  [][]string{{"base"}, {"left"}, {"late"}},
+		},
+		// Ordering with services that are not started is ignored
+		{
+			names: []string{"late", "top"},
+			want:  [][]string{{"late", "top"}},
+		},
+	}
+	for _, tt := range tests {
+		if got := g.Levels(tt.names); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Levels(%v) = %v, want %v", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestDependencyBefore(t *testing.T) {
+	g, err := NewDependencyGraph(map[string]*ServiceConfig{
+		"web":     {Requires: []string{"db"}, Wants: []string{"cache"}, After: []string{"migrate"}},
+		"db":      {},
+		"cache":   {},
+		"migrate": {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+	}{
+		// wants does not order
+		{"web", []string{"web", "db", "cache", "migrate"}, []string{"db", "migrate"}},
+		// Services that are not started are ignored
+		{"web", []string{"web", "db", "cache"}, []string{"db"}},
+		{"db", []string{"web", "db"}, nil},
+	}
+	for _, tt := range tests {
+		if got := g.Before(tt.name, tt.names); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Before(%s, %v) = %v, want %v", tt.name, tt.names, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LoadEnvFile parses a dotenv style file. Each line is KEY=VALUE, optionally
+// prefixed with "export". Values may be single quoted (taken literally) or
+// double quoted (supporting \n, \t, \" and \\ escapes). Blank lines and lines
+// starting with # are ignored.
+func LoadEnvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open env file: %w", err)
+	}
+	defer file.Close()
+
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !validEnvKey(key) {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNo)
+		}
+
+		value, err := parseEnvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		env[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read env file: %w", err)
+	}
+	return env, nil
+}
+
+func parseEnvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch value[0] {
+	case '\'':
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		return value[1 : end+1], nil
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			c := value[i]
+			switch {
+			case c == '"':
+				return b.String(), nil
+			case c == '\\' && i+1 < len(value):
+				i++
+				switch value[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(value[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated double quote")
+	default:
+		// Unquoted values end at an inline comment
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		return value, nil
+	}
+}
+
+func validEnvKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, "= \t\x00")
+}
+
+// Environment builds the environment of the service process. The daemon's
+// own environment is the base unless inherit_env is false. When the service
+// runs as another user with a passwd entry, HOME, USER and LOGNAME describe
+// that user. Env files are applied in order and env entries take precedence
+// over everything else.
+func (c *ServiceConfig) Environment() ([]string, error) {
+	values := make(map[string]string)
+	var order []string
+	set := func(key, value string) {
+		if _, exists := values[key]; !exists {
+			order = append(order, key)
+		}
+		values[key] = value
+	}
+
+	if c.InheritEnv == nil || *c.InheritEnv {
+		for _, kv := range os.Environ() {
+			if key, value, ok := strings.Cut(kv, "="); ok {
+				set(key, value)
+			}
+		}
+	}
+
+	if c.User != "" {
+		u, err := lookupUser(c.User)
+		if err != nil {
+			return nil, err
+		}
+		// A bare UID has no passwd entry to take them from
+		if u.Username != "" {
+			set("HOME", u.HomeDir)
+			set("USER", u.Username)
+			set("LOGNAME", u.Username)
+		}
+	}
+
+	for _, path := range c.EnvFile {
+		if !filepath.IsAbs(path) && c.Dir != "" {
+			path = filepath.Join(c.Dir, path)
+		}
+		fileEnv, err := LoadEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range sortedKeys(fileEnv) {
+			set(key, fileEnv[key])
+		}
+	}
+
+	for _, key := range sortedKeys(c.Env) {
+		set(key, c.Env[key])
+	}
+
+	env := make([]string, 0, len(order))
+	for _, key := range order {
+		env = append(env, key+"="+values[key])
+	}
+	return env, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
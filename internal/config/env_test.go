@@ -0,0 +1,168 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvValue(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"a b", "a b"},
+		{"value # comment", "value"},
+		{"a#b", "a#b"},
+		{"'single # kept'", "single # kept"},
+		{`'no \n escapes'`, `no \n escapes`},
+		{`"double # kept"`, "double # kept"},
+		{`"a\nb\tc"`, "a\nb\tc"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"back\\slash"`, `back\slash`},
+		{`"\$HOME"`, "$HOME"},
+		{`"quoted" # comment`, "quoted"},
+		{`""`, ""},
+		{`''`, ""},
+	}
+	for _, tt := range tests {
+		got, err := parseEnvValue(tt.in)
+		if err != nil {
+			t.Errorf("parseEnvValue(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseEnvValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{`'open`, `"open`, `"open\"`} {
+		if _, err := parseEnvValue(in); err == nil {
+			t.Errorf("parseEnvValue(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func writeEnvFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	path := writeEnvFile(t, t.TempDir(), "app.env", `
+# database settings
+DB_HOST=localhost
+  DB_PORT = 5432
+export DB_USER=app
+export   DB_NAME='app # prod'
+DB_PASS="p@ss\"word\n"
+EMPTY=
+URL=http://example.com/a=b # the url
+`)
+	got, err := LoadEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"DB_HOST": "localhost",
+		"DB_PORT": "5432",
+		"DB_USER": "app",
+		"DB_NAME": "app # prod",
+		"DB_PASS": "p@ss\"word\n",
+		"EMPTY":   "",
+		"URL":     "http://example.com/a=b",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadEnvFile = %q, want %q", got, want)
+	}
+}
+
+func TestLoadEnvFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content, err string
+	}{
+		{"OK=1\nnot a pair\n", "app.env:2: expected KEY=VALUE"},
+		{"=value\n", "app.env:1: expected KEY=VALUE"},
+		{"BAD KEY=1\n", "app.env:1: expected KEY=VALUE"},
+		{"OK=1\n\nOPEN=\"value\n", "app.env:3: unterminated double quote"},
+	}
+	for _, tt := range tests {
+		path := writeEnvFile(t, dir, "app.env", tt.content)
+		_, err := LoadEnvFile(path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("LoadEnvFile(%q) error = %v, want %q", tt.content, err, tt.err)
+		}
+	}
+
+	if _, err := LoadEnvFile(filepath.Join(dir, "missing.env")); err == nil {
+		t.Error("LoadEnvFile of a missing file succeeded")
+	}
+}
+
+func TestEnvironmentPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	writeEnvFile(t, dir, "base.env", "FROM_FILE=base\nOVERRIDE=base\nSHARED=base\n")
+	local := writeEnvFile(t, dir, "local.env", "OVERRIDE=local\nSHARED=local\n")
+	t.Setenv("ETERNAL_TEST_INHERITED", "daemon")
+	t.Setenv("SHARED", "daemon")
+	t.Setenv("FROM_ENV", "daemon")
+
+	cfg := &ServiceConfig{
+		Dir: dir,
+		// Relative paths are resolved against dir
+		EnvFile: []string{"base.env", local},
+		Env:     map[string]string{"FROM_ENV": "env", "ONLY_ENV": "env"},
+	}
+	env, err := cfg.Environment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := envMap(t, env)
+	want := map[string]string{
+		"ETERNAL_TEST_INHERITED": "daemon",
+		"FROM_FILE":              "base",
+		"OVERRIDE":               "local",
+		"SHARED":                 "local",
+		"FROM_ENV":               "env",
+		"ONLY_ENV":               "env",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+
+	inherit := false
+	cfg.InheritEnv = &inherit
+	env, err = cfg.Environment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = envMap(t, env)
+	delete(want, "ETERNAL_TEST_INHERITED")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("without inherit_env: %q, want %q", got, want)
+	}
+}
+
+// envMap turns an environment into a map, failing on duplicate keys
+func envMap(t *testing.T, env []string) map[string]string {
+	t.Helper()
+	m := make(map[string]string)
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		if _, dup := m[key]; dup {
+			t.Fatalf("duplicate key %s", key)
+		}
+		m[key] = value
+	}
+	return m
+}
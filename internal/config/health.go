@@ -0,0 +1,95 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Defaults for the fields of HealthCheck
+const (
+	DefaultHealthInterval = 10 * time.Second
+	DefaultHealthTimeout  = 5 * time.Second
+	DefaultHealthRetries  = 3
+)
+
+// HealthCheck periodically probes a running service. Exactly one of HTTP,
+// TCP and Exec must be set.
+type HealthCheck struct {
+	// URL requested with GET, healthy on ExpectStatus or any 2xx/3xx status
+	HTTP         string `yaml:"http,omitempty"`
+	ExpectStatus int    `yaml:"expect_status,omitempty"`
+	// Address (host:port) that must accept connections
+	TCP string `yaml:"tcp,omitempty"`
+	// Command line run like the service, healthy on exit status 0
+	Exec string `yaml:"exec,omitempty"`
+
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	// Consecutive failures before the service is unhealthy
+	Retries int `yaml:"retries,omitempty"`
+	// Failures within this time after the start are not counted
+	StartPeriod time.Duration `yaml:"start_period,omitempty"`
+	// Restart the service after this many consecutive failures, 0 never
+	RestartAfter int `yaml:"restart_after,omitempty"`
+}
+
+// Command returns the argv of an exec probe
+func (h *HealthCheck) Command() ([]string, error) {
+	argv, err := SplitCommand(h.Exec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid healthcheck exec: %w", err)
+	}
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("healthcheck exec is empty")
+	}
+	return argv, nil
+}
+
+// validate checks a health check and fills in defaults for unset fields
+func (h *HealthCheck) validate() error {
+	probes := 0
+	if h.HTTP != "" {
+		probes++
+		u, err := url.Parse(h.HTTP)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid healthcheck http: %q", h.HTTP)
+		}
+	}
+	if h.TCP != "" {
+		probes++
+		if _, _, err := net.SplitHostPort(h.TCP); err != nil {
+			return fmt.Errorf("invalid healthcheck tcp: %w", err)
+		}
+	}
+	if h.Exec != "" {
+		probes++
+		if _, err := h.Command(); err != nil {
+			return err
+		}
+	}
+	if probes != 1 {
+		return fmt.Errorf("healthcheck needs exactly one of http, tcp and exec")
+	}
+	if h.ExpectStatus != 0 && h.HTTP == "" {
+		return fmt.Errorf("healthcheck expect_status requires http")
+	}
+
+	if h.Interval < 0 || h.Timeout < 0 || h.StartPeriod < 0 {
+		return fmt.Errorf("healthcheck durations must not be negative")
+	}
+	if h.Retries < 0 || h.RestartAfter < 0 {
+		return fmt.Errorf("healthcheck retries and restart_after must not be negative")
+	}
+	if h.Interval == 0 {
+		h.Interval = DefaultHealthInterval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = DefaultHealthTimeout
+	}
+	if h.Retries == 0 {
+		h.Retries = DefaultHealthRetries
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Unlimited is the value of a limit that does not restrict anything
+const Unlimited = ^uint64(0)
+
+// Limits are resource limits (setrlimit) applied to the service process
+// before it is executed. Unset limits are inherited from the daemon.
+type Limits struct {
+	// Open file descriptors
+	NoFile *Limit `yaml:"nofile,omitempty"`
+	// Processes (threads) of the user the service runs as
+	NProc *Limit `yaml:"nproc,omitempty"`
+	// Size of core dumps in bytes
+	Core *Limit `yaml:"core,omitempty"`
+	// Address space in bytes
+	AS *Limit `yaml:"as,omitempty"`
+	// Stack size in bytes
+	Stack *Limit `yaml:"stack,omitempty"`
+	// CPU time in seconds
+	CPU *Limit `yaml:"cpu,omitempty"`
+}
+
+// Each calls fn for every set limit with its name
+func (l *Limits) Each(fn func(name string, limit Limit)) {
+	for _, entry := range []struct {
+		name  string
+		limit *Limit
+	}{
+		{"nofile", l.NoFile}, {"nproc", l.NProc}, {"core", l.Core},
+		{"as", l.AS}, {"stack", l.Stack}, {"cpu", l.CPU},
+	} {
+		if entry.limit != nil {
+			fn(entry.name, *entry.limit)
+		}
+	}
+}
+
+func (l *Limits) validate() error {
+	var err error
+	l.Each(func(name string, limit Limit) {
+		if err == nil && limit.Soft > limit.Hard {
+			err = fmt.Errorf("invalid limits %s: soft limit %s exceeds hard limit %s", name, formatLimit(limit.Soft), formatLimit(limit.Hard))
+		}
+	})
+	return err
+}
+
+// Limit is a soft and a hard resource limit. In YAML it is written as one
+// value for both, or as "soft:hard". "infinity" removes the limit, sizes may
+// carry a unit such as "512M".
+type Limit struct {
+	Soft, Hard uint64
+}
+
+// ParseLimit parses a limit such as "1024", "1024:4096" or "0:infinity"
+func ParseLimit(s string) (Limit, error) {
+	softStr, hardStr, pair := strings.Cut(s, ":")
+	soft, err := parseLimitValue(softStr)
+	if err != nil {
+		return Limit{}, err
+	}
+	hard := soft
+	if pair {
+		if hard, err = parseLimitValue(hardStr); err != nil {
+			return Limit{}, err
+		}
+	}
+	return Limit{Soft: soft, Hard: hard}, nil
+}
+
+func parseLimitValue(s string) (uint64, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "infinity", "unlimited":
+		return Unlimited, nil
+	}
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit: %s", s)
+	}
+	return uint64(size), nil
+}
+
+func formatLimit(v uint64) string {
+	if v == Unlimited {
+		return "infinity"
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+// String returns the limit as "soft:hard"
+func (l Limit) String() string {
+	return formatLimit(l.Soft) + ":" + formatLimit(l.Hard)
+}
+
+// UnmarshalYAML accepts numbers and strings in the format of ParseLimit
+func (l *Limit) UnmarshalYAML(value *yaml.Node) error {
+	var raw string
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	limit, err := ParseLimit(raw)
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+// MarshalYAML writes the limit in the format of ParseLimit
+func (l Limit) MarshalYAML() (interface{}, error) {
+	return l.String(), nil
+}
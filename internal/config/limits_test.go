@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Limit
+	}{
+		{"1024", Limit{1024, 1024}},
+		{"1024:4096", Limit{1024, 4096}},
+		{" 1024 : 4096 ", Limit{1024, 4096}},
+		{"0", Limit{0, 0}},
+		{"infinity", Limit{Unlimited, Unlimited}},
+		{"unlimited", Limit{Unlimited, Unlimited}},
+		{"Infinity", Limit{Unlimited, Unlimited}},
+		{"0:infinity", Limit{0, Unlimited}},
+		{"1024:unlimited", Limit{1024, Unlimited}},
+		{"512M", Limit{512 << 20, 512 << 20}},
+		{"8M:1G", Limit{8 << 20, 1 << 30}},
+		// Parsed as given, validation rejects it
+		{"4096:1024", Limit{4096, 1024}},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimit(tt.in)
+		if err != nil {
+			t.Errorf("ParseLimit(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseLimit(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", ":", "1024:", ":1024", "many", "1024:many", "-1", "1:2:3"} {
+		if _, err := ParseLimit(in); err == nil {
+			t.Errorf("ParseLimit(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestLimitString(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		want  string
+	}{
+		{Limit{1024, 4096}, "1024:4096"},
+		{Limit{0, Unlimited}, "0:infinity"},
+		{Limit{Unlimited, Unlimited}, "infinity:infinity"},
+	}
+	for _, tt := range tests {
+		if got := tt.limit.String(); got != tt.want {
+			t.Errorf("%v.String() = %q, want %q", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigLimits(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want *Limits
+		err  string
+	}{
+		{
+			yaml: "limits:\n  nofile: 1024:4096\n  core: 0\n  cpu: infinity\n  as: 1G\n",
+			want: &Limits{
+				NoFile: &Limit{1024, 4096},
+				Core:   &Limit{0, 0},
+				CPU:    &Limit{Unlimited, Unlimited},
+				AS:     &Limit{1 << 30, 1 << 30},
+			},
+		},
+		{yaml: "limits:\n  nproc: 100:unlimited\n", want: &Limits{NProc: &Limit{100, Unlimited}}},
+		{yaml: "limits:\n  nofile: 4096:1024\n", err: "invalid limits nofile: soft limit 4096 exceeds hard limit 1024"},
+		{yaml: "limits:\n  stack: infinity:8M\n", err: "invalid limits stack: soft limit infinity exceeds hard limit 8388608"},
+		{yaml: "limits:\n  nofile: lots\n", err: "invalid limit: lots"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "service.yaml")
+		if err := os.WriteFile(path, []byte("exec: sleep 1\n"+tt.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("LoadConfig(%q) error = %v, want %q", tt.yaml, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("LoadConfig(%q): %v", tt.yaml, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.Limits, tt.want) {
+			t.Errorf("LoadConfig(%q) limits = %+v, want %+v", tt.yaml, *cfg.Limits, *tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// DefaultStartTimeout bounds how long a service may take to become ready
+const DefaultStartTimeout = 90 * time.Second
+
+// Readiness tells when a started service is ready to be used. Exactly one
+// condition must be set.
+type Readiness struct {
+	// Address (host:port) that accepts connections
+	TCP string `yaml:"tcp,omitempty"`
+	// File that exists, relative paths are resolved against Dir
+	File string `yaml:"file,omitempty"`
+	// Regular expression matching a line of output
+	Log string `yaml:"log,omitempty"`
+	// The health check succeeded once
+	HealthCheck bool `yaml:"healthcheck,omitempty"`
+	// The service sent READY=1 to the socket named in NOTIFY_SOCKET
+	Notify bool `yaml:"notify,omitempty"`
+}
+
+// validate checks the readiness condition of the service c
+func (r *Readiness) validate(c *ServiceConfig) error {
+	conditions := 0
+	if r.TCP != "" {
+		conditions++
+		if _, _, err := net.SplitHostPort(r.TCP); err != nil {
+			return fmt.Errorf("invalid ready tcp: %w", err)
+		}
+	}
+	if r.File != "" {
+		conditions++
+	}
+	if r.Log != "" {
+		conditions++
+		if _, err := regexp.Compile(r.Log); err != nil {
+			return fmt.Errorf("invalid ready log: %w", err)
+		}
+	}
+	if r.HealthCheck {
+		conditions++
+		if c.HealthCheck == nil {
+			return fmt.Errorf("ready healthcheck requires a healthcheck")
+		}
+	}
+	if r.Notify {
+		conditions++
+	}
+	if conditions != 1 {
+		return fmt.Errorf("ready needs exactly one of tcp, file, log, healthcheck and notify")
+	}
+	if c.Type == ServiceOneshot {
+		return fmt.Errorf("ready is not supported for oneshot services, they are ready once they exit")
+	}
+	return nil
+}
+
+// ReadyFilePath returns the path of the ready file, resolved against Dir
+func (c *ServiceConfig) ReadyFilePath() string {
+	if c.Ready == nil {
+		return ""
+	}
+	if c.Ready.File == "" || filepath.IsAbs(c.Ready.File) {
+		return c.Ready.File
+	}
+	return filepath.Join(c.Dir, c.Ready.File)
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// cpuMaxPeriod is the cpu.max period, in microseconds, cpu_max is based on
+const cpuMaxPeriod = 100000
+
+// HasResources reports whether any cgroup resource control field is set
+func (c *ServiceConfig) HasResources() bool {
+	return c.MemoryMax > 0 || c.MemoryHigh > 0 || c.CPUWeight > 0 || c.CPUMax != "" || c.PidsMax > 0 || c.IOWeight > 0
+}
+
+// CPUMaxValue returns cpu_max in the format of the cgroup cpu.max file
+func (c *ServiceConfig) CPUMaxValue() (string, error) {
+	if c.CPUMax == "" {
+		return fmt.Sprintf("max %d", cpuMaxPeriod), nil
+	}
+	s := strings.TrimSpace(c.CPUMax)
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if !strings.HasSuffix(s, "%") || err != nil || percent <= 0 {
+		return "", fmt.Errorf("invalid cpu_max: %q, expected a percentage such as 50%%", c.CPUMax)
+	}
+	// The kernel refuses quotas below 1ms
+	quota := int64(percent / 100 * cpuMaxPeriod)
+	if quota < 1000 {
+		quota = 1000
+	}
+	return fmt.Sprintf("%d %d", quota, cpuMaxPeriod), nil
+}
+
+func (c *ServiceConfig) validateResources() error {
+	if c.MemoryMax < 0 || c.MemoryHigh < 0 || c.PidsMax < 0 {
+		return fmt.Errorf("memory_max, memory_high and pids_max must not be negative")
+	}
+	if c.CPUWeight != 0 && (c.CPUWeight < 1 || c.CPUWeight > 10000) {
+		return fmt.Errorf("cpu_weight must be between 1 and 10000")
+	}
+	if c.IOWeight != 0 && (c.IOWeight < 1 || c.IOWeight > 10000) {
+		return fmt.Errorf("io_weight must be between 1 and 10000")
+	}
+	if _, err := c.CPUMaxValue(); err != nil {
+		return err
+	}
+	return nil
+}
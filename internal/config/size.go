@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a size in bytes. In YAML it can be written as a plain number or
+// with a binary unit suffix such as "512K", "10MB" or "1GiB".
+type ByteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size such as "100", "64K" or "1.5G"
+func ParseByteSize(s string) (ByteSize, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+
+	if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+		if n < 0 {
+			return 0, fmt.Errorf("size must not be negative: %s", s)
+		}
+		return ByteSize(n * factor), nil
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return ByteSize(f * float64(factor)), nil
+}
+
+// UnmarshalYAML accepts both numbers and strings with a unit suffix
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	var raw string
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	size, err := ParseByteSize(raw)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
@@ -0,0 +1,43 @@
+package config
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ByteSize
+	}{
+		{"0", 0},
+		{"100", 100},
+		{" 100 ", 100},
+		{"100B", 100},
+		{"64K", 64 << 10},
+		{"64k", 64 << 10},
+		{"64KB", 64 << 10},
+		{"64KiB", 64 << 10},
+		{"10M", 10 << 20},
+		{"10 MB", 10 << 20},
+		{"10mib", 10 << 20},
+		{"1G", 1 << 30},
+		{"1GiB", 1 << 30},
+		{"2T", 2 << 40},
+		{"1.5G", 3 << 29},
+		{"0.5K", 512},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		if err != nil {
+			t.Errorf("ParseByteSize(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "M", "ten", "-1", "-1K", "1X", "1.5.5M", "-0.5G"} {
+		if _, err := ParseByteSize(in); err == nil {
+			t.Errorf("ParseByteSize(%q) succeeded, want an error", in)
+		}
+	}
+}
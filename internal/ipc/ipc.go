@@ -1,5 +1,11 @@
 package ipc
 
+import (
+	"encoding/json"
+
+	"github.com/Magnetkopf/Eternal/internal/process"
+)
+
 // RequestType defines the type of action requested
 type RequestType string
 
@@ -8,16 +14,48 @@ const (
 	RequestStop    RequestType = "stop"
 	RequestRestart RequestType = "restart" // Optional, but good to define
 	RequestStatus  RequestType = "status"
+	RequestReset   RequestType = "reset"
+	// RequestLogs is answered with a Response followed by raw log lines
+	// until the stream ends or the client disconnects
+	RequestLogs RequestType = "logs"
+	// RequestList is answered with every service in Response.Data, as
+	// []ServiceInfo. RequestStatus carries the one service the same way.
+	RequestList RequestType = "list"
+	// RequestHistory is answered with the run history in Response.Data
+	RequestHistory RequestType = "history"
+	// RequestUpgrade makes the daemon re-execute its binary, keeping the
+	// services running
+	RequestUpgrade RequestType = "upgrade"
 )
 
 // Request defines the structure of a command sent to the daemon
 type Request struct {
 	Type    RequestType `json:"type"`
 	Service string      `json:"service"`
+
+	// Wait makes RequestStart return once the service is ready
+	Wait bool `json:"wait,omitempty"`
+
+	// Options for RequestLogs
+	Lines  int    `json:"lines,omitempty"`
+	Follow bool   `json:"follow,omitempty"`
+	Since  string `json:"since,omitempty"`
+	Stderr bool   `json:"stderr,omitempty"`
 }
 
 // Response defines the structure of the reply from the daemon
 type Response struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
+	// Data carries structured results, see the request types
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// ServiceInfo is the state and resource usage of a service
+type ServiceInfo struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Health string `json:"health,omitempty"`
+	// Stats is set for running services
+	Stats *process.Stats `json:"stats,omitempty"`
 }
@@ -0,0 +1,28 @@
+package logs
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// maxLineLength is the longest line kept in one piece, longer ones are split
+const maxLineLength = 64 * 1024
+
+// Pump copies r line by line into w until r reaches EOF or fails. onLine, if
+// not nil, sees every line before it is written.
+func Pump(r io.Reader, w *Writer, onLine func(line []byte)) {
+	reader := bufio.NewReaderSize(r, maxLineLength)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			if onLine != nil {
+				onLine(line)
+			}
+			w.WriteLine(line)
+		}
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package logs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// tailChunkSize is how much of the file is read at a time when seeking
+	// backwards for the last lines
+	tailChunkSize = 32 * 1024
+	// followInterval is how often a followed file is checked for new data
+	followInterval = 250 * time.Millisecond
+)
+
+// StreamOptions selects which lines Stream emits
+type StreamOptions struct {
+	// Lines is the number of most recent lines to emit, 0 means all
+	Lines int
+	// Since skips lines written before this time, zero means no limit
+	Since time.Time
+	// Follow keeps emitting lines as they are written until ctx is done
+	Follow bool
+}
+
+// ParseSince accepts either a duration relative to now ("10m") or an
+// RFC 3339 timestamp
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since value %q, expected a duration or RFC 3339 time", s)
+	}
+	return t, nil
+}
+
+// Stream emits the selected lines of the log file at path, without their
+// trailing newline. It returns when the lines are emitted, or in follow mode
+// when ctx is done or emit fails.
+func Stream(ctx context.Context, path string, opts StreamOptions, emit func(line []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if !opts.Follow {
+				// Nothing was ever written
+				return nil
+			}
+			// Wait for the file to show up
+			return follow(ctx, path, nil, 0, opts.Since, emit)
+		}
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	lines, err := tail(file, info.Size(), opts.Lines, opts.Since)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	for _, line := range lines {
+		if err := emit(line); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if !opts.Follow {
+		file.Close()
+		return nil
+	}
+	return follow(ctx, path, file, info.Size(), opts.Since, emit)
+}
+
+// tail returns up to n lines (all when n is 0) from the end of file that are
+// not older than since, in file order
+func tail(file *os.File, size int64, n int, since time.Time) ([][]byte, error) {
+	var reversed [][]byte
+	var rest []byte // start of a line that began in an earlier chunk
+	pos := size
+
+	for pos > 0 {
+		chunk := int64(tailChunkSize)
+		if chunk > pos {
+			chunk = pos
+		}
+		pos -= chunk
+
+		buf := make([]byte, chunk, chunk+int64(len(rest)))
+		if _, err := file.ReadAt(buf, pos); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read log file: %w", err)
+		}
+		data := append(buf, rest...)
+
+		complete := data
+		rest = nil
+		if pos > 0 {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				rest = data
+				continue
+			}
+			rest = data[:i+1]
+			complete = data[i+1:]
+		}
+
+		lines := bytes.SplitAfter(complete, []byte{'\n'})
+		for i := len(lines) - 1; i >= 0; i-- {
+			line := bytes.TrimSuffix(lines[i], []byte{'\n'})
+			if len(lines[i]) == 0 {
+				continue
+			}
+			if !since.IsZero() {
+				if t, ok := ParseLineTime(line); ok && t.Before(since) {
+					return reverse(reversed), nil
+				}
+			}
+			reversed = append(reversed, line)
+			if n > 0 && len(reversed) == n {
+				return reverse(reversed), nil
+			}
+		}
+	}
+	return reverse(reversed), nil
+}
+
+func reverse(lines [][]byte) [][]byte {
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// follow polls path for data written after offset, switching to the new
+// file when the log is rotated
+func follow(ctx context.Context, path string, file *os.File, offset int64, since time.Time, emit func(line []byte) error) error {
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	var partial []byte
+	buf := make([]byte, tailChunkSize)
+
+	// drain emits everything from offset to the current end of file
+	drain := func() error {
+		for {
+			n, err := file.ReadAt(buf, offset)
+			offset += int64(n)
+			data := append(partial, buf[:n]...)
+			partial = nil
+			for {
+				i := bytes.IndexByte(data, '\n')
+				if i < 0 {
+					break
+				}
+				line := data[:i]
+				data = data[i+1:]
+				if !since.IsZero() {
+					if t, ok := ParseLineTime(line); ok && t.Before(since) {
+						continue
+					}
+				}
+				if err := emit(line); err != nil {
+					return err
+				}
+			}
+			partial = append(partial, data...)
+			if err == io.EOF || n == 0 {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read log file: %w", err)
+			}
+		}
+	}
+
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+
+	for {
+		if file != nil {
+			if err := drain(); err != nil {
+				return err
+			}
+
+			// Reopen when the file was rotated away or truncated
+			current, err := os.Stat(path)
+			info, statErr := file.Stat()
+			if err == nil && statErr == nil && (!os.SameFile(current, info) || current.Size() < offset) {
+				if err := drain(); err != nil {
+					return err
+				}
+				file.Close()
+				file = nil
+				partial = nil
+			}
+		}
+
+		if file == nil {
+			if f, err := os.Open(path); err == nil {
+				file = f
+				offset = 0
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package logs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TimeFormat is the timestamp written in front of every log line
+const TimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// RotateOptions controls when a Writer rotates its file
+type RotateOptions struct {
+	// MaxSize rotates the file before it grows beyond this many bytes, 0 disables
+	MaxSize int64
+	// MaxFiles is the number of rotated files to keep
+	MaxFiles int
+	// MaxAge rotates the file once its first line is older than this, 0 disables
+	MaxAge time.Duration
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// Writer appends timestamped lines to a log file and rotates it according to
+// its RotateOptions. It is safe for concurrent use, so stdout and stderr of a
+// service can share one file.
+type Writer struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	created time.Time
+	opts    RotateOptions
+	// compressing tracks the background gzip of the last rotated file
+	compressing sync.WaitGroup
+}
+
+// NewWriter opens (or creates) the log file at path for appending
+func NewWriter(path string, opts RotateOptions) (*Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	w := &Writer{path: path, opts: opts}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Path returns the path of the log file
+func (w *Writer) Path() string {
+	return w.path
+}
+
+// SetOptions replaces the rotation options
+func (w *Writer) SetOptions(opts RotateOptions) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.opts = opts
+}
+
+// WriteLine writes a single line prefixed with the current time. A trailing
+// newline is added if line does not already end with one.
+func (w *Writer) WriteLine(line []byte) error {
+	now := time.Now()
+	buf := make([]byte, 0, len(TimeFormat)+len(line)+2)
+	buf = now.AppendFormat(buf, TimeFormat)
+	buf = append(buf, ' ')
+	buf = append(buf, line...)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		buf = append(buf, '\n')
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return os.ErrClosed
+	}
+
+	if w.shouldRotate(now, int64(len(buf))) {
+		if err := w.rotate(); err != nil {
+			// Keep logging into the current file rather than losing output
+			fmt.Printf("Failed to rotate log %s: %v\n", w.path, err)
+		}
+		if w.file == nil {
+			return os.ErrClosed
+		}
+	}
+
+	n, err := w.file.Write(buf)
+	w.size += int64(n)
+	return err
+}
+
+// Close closes the underlying file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.compressing.Wait()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// open opens the active file and works out its size and age
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	w.file = file
+	w.size = info.Size()
+	w.created = time.Now()
+	if w.size > 0 {
+		if t, ok := firstLineTime(w.path); ok {
+			w.created = t
+		} else {
+			w.created = info.ModTime()
+		}
+	}
+	return nil
+}
+
+func (w *Writer) shouldRotate(now time.Time, incoming int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.opts.MaxSize > 0 && w.size+incoming > w.opts.MaxSize {
+		return true
+	}
+	return w.opts.MaxAge > 0 && now.Sub(w.created) >= w.opts.MaxAge
+}
+
+// rotate shifts <path>.N to <path>.N+1, moves the active file to <path>.1 and
+// reopens an empty one. The caller must hold w.mu.
+func (w *Writer) rotate() error {
+	// The previous rotation may still be compressing <path>.1
+	w.compressing.Wait()
+
+	maxFiles := w.opts.MaxFiles
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+
+	for i := maxFiles; i >= 1; i-- {
+		for _, ext := range []string{"", ".gz"} {
+			src := w.rotatedName(i) + ext
+			if _, err := os.Stat(src); err != nil {
+				continue
+			}
+			if i == maxFiles {
+				os.Remove(src)
+			} else {
+				os.Rename(src, w.rotatedName(i+1)+ext)
+			}
+		}
+	}
+
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	renameErr := os.Rename(w.path, w.rotatedName(1))
+	if err := w.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	if w.opts.Compress {
+		rotated := w.rotatedName(1)
+		w.compressing.Add(1)
+		go func() {
+			defer w.compressing.Done()
+			if err := compressFile(rotated); err != nil {
+				fmt.Printf("Failed to compress log %s: %v\n", rotated, err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (w *Writer) rotatedName(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
+
+// firstLineTime parses the timestamp of the first line of a log file
+func firstLineTime(path string) (time.Time, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer file.Close()
+
+	buf := make([]byte, len(TimeFormat)+6)
+	n, _ := file.Read(buf)
+	return ParseLineTime(buf[:n])
+}
+
+// ParseLineTime extracts the timestamp written by Writer at the start of line
+func ParseLineTime(line []byte) (time.Time, bool) {
+	end := bytes.IndexByte(line, ' ')
+	if end < 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(TimeFormat, string(line[:end]))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,186 @@
+package logs
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logFiles returns the names of the files in dir
+func logFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readLog returns the log lines of a file without their timestamps
+func readLog(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if _, ok := ParseLineTime([]byte(line)); !ok {
+			t.Fatalf("%s: line without timestamp: %q", path, line)
+		}
+		_, text, _ := strings.Cut(line, " ")
+		lines = append(lines, text)
+	}
+	return lines
+}
+
+// line returns a log line of 50 bytes, so two of them exceed 100 bytes
+func line(i int) string {
+	return strings.Repeat(string(rune('a'+i)), 50)
+}
+
+func TestWriterRotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "svc.out.log")
+	w, err := NewWriter(path, RotateOptions{MaxSize: 100, MaxFiles: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := w.WriteLine([]byte(line(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every line but the first rotated, only the newest three rotated files
+	// are kept
+	want := []string{"svc.out.log", "svc.out.log.1", "svc.out.log.2", "svc.out.log.3"}
+	if got := logFiles(t, dir); !slices.Equal(got, want) {
+		t.Fatalf("files = %v, want %v", got, want)
+	}
+	for name, i := range map[string]int{"svc.out.log": 5, "svc.out.log.1": 4, "svc.out.log.2": 3, "svc.out.log.3": 2} {
+		if got := readLog(t, filepath.Join(dir, name)); !slices.Equal(got, []string{line(i)}) {
+			t.Errorf("%s = %q, want line %d", name, got, i)
+		}
+	}
+}
+
+func TestWriterKeepsLinesBelowMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "svc.out.log")
+	w, err := NewWriter(path, RotateOptions{MaxSize: 1000, MaxFiles: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		w.WriteLine([]byte(line(i)))
+	}
+	w.Close()
+
+	if got := logFiles(t, dir); !slices.Equal(got, []string{"svc.out.log"}) {
+		t.Fatalf("files = %v, want only the active one", got)
+	}
+	if got := readLog(t, path); len(got) != 3 {
+		t.Errorf("lines = %q, want 3", got)
+	}
+}
+
+func TestWriterMaxFilesOne(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "svc.out.log")
+	w, err := NewWriter(path, RotateOptions{MaxSize: 100, MaxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		w.WriteLine([]byte(line(i)))
+	}
+	w.Close()
+
+	want := []string{"svc.out.log", "svc.out.log.1"}
+	if got := logFiles(t, dir); !slices.Equal(got, want) {
+		t.Fatalf("files = %v, want %v", got, want)
+	}
+	if got := readLog(t, path+".1"); !slices.Equal(got, []string{line(2)}) {
+		t.Errorf("rotated file = %q, want line 2", got)
+	}
+}
+
+func TestWriterCompresses(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "svc.err.log")
+	w, err := NewWriter(path, RotateOptions{MaxSize: 100, MaxFiles: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		w.WriteLine([]byte(line(i)))
+	}
+	// Close waits for the compression
+	w.Close()
+
+	want := []string{"svc.err.log", "svc.err.log.1.gz", "svc.err.log.2.gz"}
+	if got := logFiles(t, dir); !slices.Equal(got, want) {
+		t.Fatalf("files = %v, want %v", got, want)
+	}
+	if got := readLog(t, path+".1.gz"); !slices.Equal(got, []string{line(2)}) {
+		t.Errorf("svc.err.log.1.gz = %q, want line 2", got)
+	}
+	if got := readLog(t, path+".2.gz"); !slices.Equal(got, []string{line(1)}) {
+		t.Errorf("svc.err.log.2.gz = %q, want line 1", got)
+	}
+}
+
+func TestWriterRotatesByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "svc.out.log")
+	old := time.Now().Add(-2*time.Hour).Format(TimeFormat) + " old\n"
+	if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWriter(path, RotateOptions{MaxAge: time.Hour, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteLine([]byte("new"))
+	// The new file is younger than MaxAge
+	w.WriteLine([]byte("newer"))
+	w.Close()
+
+	if got := readLog(t, path+".1"); !slices.Equal(got, []string{"old"}) {
+		t.Errorf("rotated file = %q, want the old line", got)
+	}
+	if got := readLog(t, path); !slices.Equal(got, []string{"new", "newer"}) {
+		t.Errorf("active file = %q, want the new lines", got)
+	}
+}
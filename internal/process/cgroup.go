@@ -0,0 +1,394 @@
+package process
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// cgroupControllers are the cgroup v2 controllers the daemon enables for
+// services, if available
+var cgroupControllers = []string{"cpu", "memory", "io", "pids"}
+
+// Names within the cgroup of the daemon. The daemon moves itself into a leaf
+// so controllers can be enabled for the services next to it.
+const (
+	daemonCgroup   = "daemon"
+	servicesCgroup = "services"
+)
+
+// errOOMKill is the reason of runs that ended after the kernel killed a
+// process of the service for running out of memory
+var errOOMKill = errors.New("oom-kill")
+
+// SetupCgroups prepares a cgroup v2 subtree for the services below the
+// cgroup of the daemon. It only touches the cgroup if it was delegated to the
+// daemon and the daemon is alone in it; otherwise, or if the setup fails
+// halfway, everything is left as it was and services run without resource
+// control.
+func (m *Manager) SetupCgroups() error {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return err
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		return err
+	}
+	if own == "/" {
+		return fmt.Errorf("the daemon runs in the root cgroup, which is never delegated")
+	}
+	base := filepath.Join(mount, own)
+	if err := checkDelegated(base); err != nil {
+		return err
+	}
+	pids, err := cgroupProcesses(base)
+	if err != nil {
+		return fmt.Errorf("failed to read cgroup processes: %w", err)
+	}
+	if len(pids) != 1 || pids[0] != os.Getpid() {
+		return fmt.Errorf("the cgroup %s holds other processes besides the daemon", base)
+	}
+
+	setup := &cgroupSetup{base: base}
+	controllers, err := setup.run()
+	if err != nil {
+		setup.undo()
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cgroupBase = base
+	m.cgroupDir = filepath.Join(base, servicesCgroup)
+	m.controllers = controllers
+	return nil
+}
+
+// ResumeCgroups takes over the cgroup subtree set up by the daemon instance
+// that handed over to this one
+func (m *Manager) ResumeCgroups(base string) error {
+	services := filepath.Join(base, servicesCgroup)
+	data, err := os.ReadFile(filepath.Join(services, "cgroup.subtree_control"))
+	if err != nil {
+		return fmt.Errorf("failed to read cgroup controllers: %w", err)
+	}
+	controllers := make(map[string]bool)
+	for _, c := range strings.Fields(string(data)) {
+		controllers[c] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cgroupBase = base
+	m.cgroupDir = services
+	m.controllers = controllers
+	return nil
+}
+
+// CgroupBase returns the cgroup the daemon set up for itself and the
+// services, "" without cgroup support
+func (m *Manager) CgroupBase() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cgroupBase
+}
+
+// delegateXattrs mark a cgroup systemd delegated to the service in it
+var delegateXattrs = []string{"trusted.delegate", "user.delegate"}
+
+// checkDelegated fails unless the cgroup was delegated to the daemon: marked
+// so by systemd, or, for an unprivileged daemon, owned by it. root owns every
+// cgroup, so ownership proves nothing for it.
+func checkDelegated(dir string) error {
+	for _, attr := range delegateXattrs {
+		buf := make([]byte, 16)
+		if n, err := syscall.Getxattr(dir, attr, buf); err == nil && n > 0 && buf[0] == '1' {
+			return nil
+		}
+	}
+
+	euid := os.Geteuid()
+	if euid != 0 {
+		owned := true
+		for _, path := range []string{dir, filepath.Join(dir, "cgroup.procs"), filepath.Join(dir, "cgroup.subtree_control")} {
+			var st syscall.Stat_t
+			if err := syscall.Stat(path, &st); err != nil || int(st.Uid) != euid {
+				owned = false
+				break
+			}
+		}
+		if owned {
+			return nil
+		}
+	}
+	return fmt.Errorf("the cgroup %s was not delegated to the daemon", dir)
+}
+
+// cgroupSetup builds the subtree of the daemon and remembers its steps, so
+// they can be undone if one fails
+type cgroupSetup struct {
+	base    string
+	created []string
+	moved   bool
+	enabled []string
+}
+
+func (s *cgroupSetup) run() (map[string]bool, error) {
+	leaf := filepath.Join(s.base, daemonCgroup)
+	if err := s.mkdir(leaf); err != nil {
+		return nil, err
+	}
+	if err := writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return nil, err
+	}
+	s.moved = true
+
+	controllers, err := enableControllers(s.base, nil, &s.enabled)
+	if err != nil {
+		return nil, err
+	}
+	services := filepath.Join(s.base, servicesCgroup)
+	if err := s.mkdir(services); err != nil {
+		return nil, err
+	}
+	return enableControllers(services, controllers, nil)
+}
+
+func (s *cgroupSetup) mkdir(dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	s.created = append(s.created, dir)
+	return nil
+}
+
+// undo disables the controllers enabled in base, moves the daemon back into
+// it and removes the cgroups that were created
+func (s *cgroupSetup) undo() {
+	for _, c := range s.enabled {
+		writeCgroupFile(s.base, "cgroup.subtree_control", "-"+c)
+	}
+	if s.moved {
+		writeCgroupFile(s.base, "cgroup.procs", strconv.Itoa(os.Getpid()))
+	}
+	for i := len(s.created) - 1; i >= 0; i-- {
+		os.Remove(s.created[i])
+	}
+}
+
+// cgroup2Mount returns where the cgroup v2 hierarchy is mounted
+func cgroup2Mount() (string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The file system type follows the " - " separator
+		fields, fsType, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok || !strings.HasPrefix(fsType, "cgroup2 ") {
+			continue
+		}
+		if parts := strings.Fields(fields); len(parts) >= 5 {
+			return parts[4], nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 hierarchy is mounted")
+}
+
+// ownCgroup returns the cgroup v2 path of the daemon
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("the daemon is not in a cgroup v2 hierarchy")
+}
+
+// enableControllers enables the wanted controllers (all of
+// cgroupControllers if nil) for the children of dir, as far as they are
+// available, and returns the enabled ones. Controllers that were not enabled
+// before are appended to added, if given.
+func enableControllers(dir string, wanted map[string]bool, added *[]string) (map[string]bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroup controllers: %w", err)
+	}
+	available := make(map[string]bool)
+	for _, c := range strings.Fields(string(data)) {
+		available[c] = true
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroup controllers: %w", err)
+	}
+	active := make(map[string]bool)
+	for _, c := range strings.Fields(string(data)) {
+		active[c] = true
+	}
+
+	enabled := make(map[string]bool)
+	for _, c := range cgroupControllers {
+		if !available[c] || (wanted != nil && !wanted[c]) {
+			continue
+		}
+		if !active[c] {
+			if err := writeCgroupFile(dir, "cgroup.subtree_control", "+"+c); err != nil {
+				return nil, err
+			}
+			if added != nil {
+				*added = append(*added, c)
+			}
+		}
+		enabled[c] = true
+	}
+	return enabled, nil
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Join(dir, name), err)
+	}
+	return nil
+}
+
+// cgroupPath returns the cgroup of a service, or "" without cgroup support.
+// The caller must hold m.mu.
+func (m *Manager) cgroupPath(name string) string {
+	if m.cgroupDir == "" {
+		return ""
+	}
+	return filepath.Join(m.cgroupDir, name)
+}
+
+// prepareCgroup creates the cgroup of a service and applies its resource
+// settings, resetting those no longer configured. It returns the cgroup, or
+// "" without cgroup support. The caller must hold m.mu.
+func (m *Manager) prepareCgroup(name string, cfg *config.ServiceConfig) (string, error) {
+	dir := m.cgroupPath(name)
+	if dir == "" {
+		if cfg.HasResources() {
+			fmt.Printf("Service %s: cgroups are not available, ignoring resource control settings\n", name)
+		}
+		return "", nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	cpuMax, err := cfg.CPUMaxValue()
+	if err != nil {
+		return "", err
+	}
+	settings := []struct {
+		controller, file, value string
+		set                     bool
+	}{
+		{"memory", "memory.max", cgroupMax(int64(cfg.MemoryMax)), cfg.MemoryMax > 0},
+		{"memory", "memory.high", cgroupMax(int64(cfg.MemoryHigh)), cfg.MemoryHigh > 0},
+		{"cpu", "cpu.weight", cgroupDefault(cfg.CPUWeight, 100), cfg.CPUWeight > 0},
+		{"cpu", "cpu.max", cpuMax, cfg.CPUMax != ""},
+		{"pids", "pids.max", cgroupMax(int64(cfg.PidsMax)), cfg.PidsMax > 0},
+		{"io", "io.weight", "default " + cgroupDefault(cfg.IOWeight, 100), cfg.IOWeight > 0},
+	}
+	for _, s := range settings {
+		if !m.controllers[s.controller] {
+			if s.set {
+				fmt.Printf("Service %s: the %s controller is not available, ignoring it\n", name, s.controller)
+			}
+			continue
+		}
+		if err := writeCgroupFile(dir, s.file, s.value); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// cgroupMax formats a limit, 0 meaning none
+func cgroupMax(v int64) string {
+	if v <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+func cgroupDefault(v, def int) string {
+	if v <= 0 {
+		v = def
+	}
+	return strconv.Itoa(v)
+}
+
+// openCgroup opens a cgroup directory for CLONE_INTO_CGROUP
+func openCgroup(dir string) (int, error) {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	return fd, nil
+}
+
+// oomKills returns the number of processes in a cgroup the kernel killed for
+// running out of memory
+func oomKills(dir string) uint64 {
+	if dir == "" {
+		return 0
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			n, _ := strconv.ParseUint(v, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// cgroupCPUSeconds reads the CPU time used in a cgroup from usage_usec of
+// cpu.stat, which is there with or without the cpu controller
+func cgroupCPUSeconds(dir string) (float64, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "usage_usec "); ok {
+			usec, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return float64(usec) / 1e6, true
+		}
+	}
+	return 0, false
+}
+
+// removeCgroup deletes the cgroup of a removed service, if it is empty.
+// The caller must hold m.mu.
+func (m *Manager) removeCgroup(name string) {
+	if dir := m.cgroupPath(name); dir != "" {
+		os.Remove(dir)
+	}
+}
@@ -0,0 +1,29 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// processCredential returns the credential a service should be started with,
+// or nil when it runs as the daemon's own user. Switching to another account
+// requires the daemon to run as root.
+func processCredential(cfg *config.ServiceConfig) (*syscall.Credential, error) {
+	cred, err := cfg.Credential()
+	if err != nil || cred == nil {
+		return nil, err
+	}
+
+	if os.Geteuid() == 0 {
+		return cred, nil
+	}
+
+	// Nothing to switch, and setgroups would fail without privilege
+	if int(cred.Uid) == os.Geteuid() && int(cred.Gid) == os.Getegid() && len(cfg.Groups) == 0 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("permission denied: the daemon must run as root to start a service as user %q group %q", cfg.User, cfg.Group)
+}
@@ -0,0 +1,143 @@
+package process
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// dependencyGraph loads the requested services and everything they depend
+// on, and builds their graph. The caller must hold m.mu.
+func (m *Manager) dependencyGraph(names []string) (*config.DependencyGraph, map[string]error) {
+	errs := make(map[string]error)
+	requested := make(map[string]bool)
+	for _, name := range names {
+		requested[name] = true
+	}
+
+	configs := make(map[string]*config.ServiceConfig)
+	queue := append([]string{}, names...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if _, ok := configs[name]; ok {
+			continue
+		}
+
+		proc, err := m.loadServiceLocked(name)
+		if err != nil {
+			// A missing requirement is reported by the graph
+			if requested[name] {
+				errs[name] = err
+			}
+			continue
+		}
+		configs[name] = proc.Config
+		queue = append(queue, proc.Config.Requires...)
+		queue = append(queue, proc.Config.Wants...)
+	}
+
+	graph, err := config.NewDependencyGraph(configs)
+	if err != nil {
+		for _, name := range names {
+			if errs[name] == nil {
+				errs[name] = err
+			}
+		}
+		return nil, errs
+	}
+	return graph, errs
+}
+
+// startState is the outcome of starting one service within StartServices
+type startState struct {
+	// settled is closed once the service is started, and ready if others wait
+	// for it, or failed to start
+	settled chan struct{}
+	err     error
+}
+
+// StartServices starts the named services along with the services they
+// require or want. Every service starts as soon as the services it requires
+// or is ordered after are ready, see WaitReady, so independent services start
+// in parallel. A service whose requirement failed is not started. With wait,
+// the named services are waited for as well. It returns the outcome for each
+// of the named services.
+func (m *Manager) StartServices(names []string, wait bool) map[string]error {
+	m.mu.Lock()
+	graph, errs := m.dependencyGraph(names)
+	m.mu.Unlock()
+	if graph == nil {
+		return errs
+	}
+
+	requested := make(map[string]bool)
+	states := make(map[string]*startState)
+	var all []string
+	for _, name := range names {
+		if errs[name] != nil {
+			continue
+		}
+		closure, err := graph.Closure(name)
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		requested[name] = true
+		for _, dep := range closure {
+			if states[dep] == nil {
+				states[dep] = &startState{settled: make(chan struct{})}
+				all = append(all, dep)
+			}
+		}
+	}
+
+	// Services others are ordered after are waited for, the named ones only
+	// with wait
+	before := make(map[string][]string)
+	awaited := make(map[string]bool)
+	for _, name := range all {
+		before[name] = graph.Before(name, all)
+		for _, dep := range before[name] {
+			awaited[dep] = true
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range all {
+		state := states[name]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(state.settled)
+			for _, dep := range before[name] {
+				<-states[dep].settled
+			}
+			state.err = requirementsFailed(graph.Requires(name), states)
+			if state.err == nil {
+				state.err = m.startOne(name, requested[name])
+			}
+			if state.err == nil && (awaited[name] || wait && requested[name]) {
+				state.err = m.WaitReady(name)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for name := range requested {
+		errs[name] = states[name].err
+	}
+	return errs
+}
+
+// requirementsFailed returns an error if one of requires failed to start. The
+// requirements must have settled.
+func requirementsFailed(requires []string, states map[string]*startState) error {
+	for _, dep := range requires {
+		if state := states[dep]; state != nil && state.err != nil {
+			return fmt.Errorf("required service %s failed to start: %w", dep, state.err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// pidFileTimeout is how long a forking service has to write its PID file
+// after the launcher exited
+const pidFileTimeout = 5 * time.Second
+
+// supervise waits for the run of a service that started along with done to
+// end. wait returns once the started process exits; for a forking service
+// that is the launcher, after which the main process named in the PID file
+// is followed.
+func (m *Manager) supervise(name string, proc *ManagedProcess, done chan struct{}, pidFile string, wait func() error) {
+	err := wait()
+	if pidFile != "" && err == nil {
+		var pid int
+		if pid, err = readPIDFile(pidFile); err == nil {
+			var ticks uint64
+			if ticks, err = m.followMainPID(name, proc, done, pid); err == nil {
+				err = m.waitPID(pid, ticks)
+			}
+		}
+	}
+	m.processExited(name, proc, done, err)
+}
+
+// readPIDFile waits for the PID file of a forking service to name a live
+// descendant of the daemon, which becomes the main process
+func readPIDFile(path string) (int, error) {
+	deadline := time.Now().Add(pidFileTimeout)
+	err := fmt.Errorf("PID file %s was not written within %s", path, pidFileTimeout)
+
+	for time.Now().Before(deadline) {
+		// A stale file from an earlier run is tolerated until the deadline
+		if data, readErr := os.ReadFile(path); readErr == nil {
+			s := strings.TrimSpace(string(data))
+			pid, convErr := strconv.Atoi(s)
+			switch {
+			case s == "":
+				// Not written yet
+			case convErr != nil || pid <= 1:
+				err = fmt.Errorf("PID file %s holds an invalid PID: %q", path, s)
+			case !isDescendant(pid):
+				err = fmt.Errorf("PID %d from %s is not a process of this service", pid, path)
+			default:
+				return pid, nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return 0, err
+}
+
+// followMainPID makes pid the main process of a forking service whose
+// launcher exited
+func (m *Manager) followMainPID(name string, proc *ManagedProcess, done chan struct{}, pid int) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.processes[name] != proc || proc.done != done {
+		return 0, fmt.Errorf("service %s was replaced", name)
+	}
+	ticks, ok := processStartTicks(pid)
+	if !ok {
+		return 0, fmt.Errorf("main process %d exited", pid)
+	}
+
+	proc.PID = pid
+	proc.startTicks = ticks
+	proc.pgid = processGroup(pid)
+	proc.launching = false
+	m.saveState()
+	if proc.Config.Ready == nil {
+		m.markReady(name, proc)
+	}
+
+	if proc.stopping {
+		// The stop request only reached the launcher
+		sig, err := config.ParseSignal(proc.Config.StopSignal)
+		if err != nil {
+			sig = syscall.SIGTERM
+		}
+		signalService(pid, proc.pgid, proc.Config.KillMode, sig)
+	}
+	return ticks, nil
+}
+
+// waitPID waits for a process that was not started by this daemon instance.
+// The exit status is only known if the process is a child of the daemon,
+// directly or as reparented orphan.
+func (m *Manager) waitPID(pid int, ticks uint64) error {
+	exited := m.reaper.watch(pid)
+	ticker := time.NewTicker(adoptPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case status := <-exited:
+			return statusError(status)
+		case <-ticker.C:
+		}
+
+		if t, ok := processStartTicks(pid); ok && t == ticks {
+			continue
+		}
+		// Gone without being reaped here, unless the reaper got it just now
+		if m.reaper.unwatch(pid) {
+			return errExitUnknown
+		}
+		return statusError(<-exited)
+	}
+}
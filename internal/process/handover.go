@@ -0,0 +1,250 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/Magnetkopf/Eternal/internal/logs"
+)
+
+// HandoverProcess is the state of a service passed from a daemon to the
+// binary it re-executes during an upgrade
+type HandoverProcess struct {
+	Name       string        `json:"name"`
+	Status     ProcessStatus `json:"status"`
+	Err        string        `json:"err,omitempty"`
+	PID        int           `json:"pid,omitempty"`
+	StartTicks uint64        `json:"start_ticks,omitempty"`
+	StartedAt  time.Time     `json:"started_at"`
+	Starts     []time.Time   `json:"starts,omitempty"`
+	Backoff    int           `json:"backoff,omitempty"`
+	// RestartPending is set when an automatic restart was scheduled
+	RestartPending bool `json:"restart_pending,omitempty"`
+	// Launching is set while the launcher of a forking service runs
+	Launching bool `json:"launching,omitempty"`
+	// StdoutFD and StderrFD are the inherited read ends of the output pipes
+	StdoutFD int `json:"stdout_fd,omitempty"`
+	StderrFD int `json:"stderr_fd,omitempty"`
+}
+
+// SetInheritable clears (or sets again) the close-on-exec flag of a file
+// descriptor so it survives an exec, and returns the descriptor number
+func SetInheritable(c syscall.Conn, inherit bool) (int, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var flag uintptr
+	if !inherit {
+		flag = syscall.FD_CLOEXEC
+	}
+	fd := -1
+	var errno syscall.Errno
+	err = raw.Control(func(f uintptr) {
+		fd = int(f)
+		_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, f, syscall.F_SETFD, flag)
+	})
+	if err != nil {
+		return -1, err
+	}
+	if errno != 0 {
+		return -1, errno
+	}
+	return fd, nil
+}
+
+// BeginHandover freezes the manager and returns its process table for the
+// next daemon instance. The output pipes of running services are made
+// inheritable. On success the manager stays locked until the process execs;
+// if the exec fails, AbortHandover must be called.
+func (m *Manager) BeginHandover() ([]HandoverProcess, error) {
+	m.mu.Lock()
+
+	if m.shuttingDown {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("daemon is shutting down")
+	}
+	for name, proc := range m.processes {
+		if proc.stopping {
+			m.mu.Unlock()
+			return nil, fmt.Errorf("service %s is stopping, try again later", name)
+		}
+	}
+
+	// Children that exit from now on stay zombies for the next instance
+	m.reaper.pause()
+
+	var table []HandoverProcess
+	for name, proc := range m.processes {
+		h := HandoverProcess{
+			Name:           name,
+			Status:         proc.Status,
+			StartedAt:      proc.startedAt,
+			Starts:         proc.starts,
+			Backoff:        proc.backoff,
+			RestartPending: proc.restartTimer != nil,
+		}
+		if proc.Err != nil {
+			h.Err = proc.Err.Error()
+		}
+		if proc.PID != 0 {
+			h.PID = proc.PID
+			h.StartTicks = proc.startTicks
+			h.Launching = proc.launching
+			if proc.output != nil {
+				var err error
+				if h.StdoutFD, err = SetInheritable(proc.output.stdout.r, true); err == nil {
+					h.StderrFD, err = SetInheritable(proc.output.stderr.r, true)
+				}
+				if err != nil {
+					m.restoreCloseOnExec()
+					m.reaper.resume()
+					m.mu.Unlock()
+					return nil, fmt.Errorf("failed to pass output of %s: %w", name, err)
+				}
+			}
+		}
+		table = append(table, h)
+	}
+
+	// Keep the start order, StopAll relies on it
+	sort.Slice(table, func(i, j int) bool {
+		return m.processes[table[i].Name].seq < m.processes[table[j].Name].seq
+	})
+	return table, nil
+}
+
+// AbortHandover unfreezes the manager after a failed exec
+func (m *Manager) AbortHandover() {
+	m.restoreCloseOnExec()
+	m.reaper.resume()
+	m.mu.Unlock()
+}
+
+// restoreCloseOnExec keeps output pipes from leaking into services started
+// later. The caller must hold m.mu.
+func (m *Manager) restoreCloseOnExec() {
+	for _, proc := range m.processes {
+		if proc.PID != 0 && proc.output != nil {
+			SetInheritable(proc.output.stdout.r, false)
+			SetInheritable(proc.output.stderr.r, false)
+		}
+	}
+}
+
+// TakeOver continues supervising the services handed over by the previous
+// daemon instance. It must be called after LoadServices and before any
+// service is started. It returns the names of the running services.
+func (m *Manager) TakeOver(table []HandoverProcess) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var running []string
+	for _, h := range table {
+		proc, exists := m.processes[h.Name]
+		if !exists {
+			if h.PID != 0 {
+				fmt.Printf("Service %s (PID %d) is running but no longer configured, leaving it alone\n", h.Name, h.PID)
+			}
+			closeFD(h.StdoutFD)
+			closeFD(h.StderrFD)
+			continue
+		}
+
+		m.startSeq++
+		proc.seq = m.startSeq
+		proc.Status = h.Status
+		proc.startedAt = h.StartedAt
+		proc.starts = h.Starts
+		proc.backoff = h.Backoff
+		if h.Err != "" {
+			proc.Err = errors.New(h.Err)
+		}
+
+		if h.PID == 0 {
+			if h.RestartPending {
+				m.scheduleRestart(h.Name, proc, restartDelay(proc.Config, proc.backoff))
+			}
+			continue
+		}
+
+		done := make(chan struct{})
+		proc.PID = h.PID
+		proc.startTicks = h.StartTicks
+		proc.Status = StatusRunning
+		proc.ready = closedChan()
+		proc.done = done
+		proc.pgid = processGroup(h.PID)
+		proc.launching = h.Launching
+		if usesNotify(proc) {
+			if _, err := m.listenNotify(h.Name, proc); err != nil {
+				fmt.Printf("Service %s: %v\n", h.Name, err)
+			}
+		}
+		if h.Status == StatusStarting {
+			// Wait for readiness again, with a fresh start timeout
+			m.awaitReady(h.Name, proc, done)
+		}
+
+		if h.StdoutFD != 0 && h.StderrFD != 0 {
+			m.resumeOutput(h.Name, proc, h.StdoutFD, h.StderrFD, m.readyLogMatcher(h.Name, proc, done))
+		}
+		var pidFile string
+		if h.Launching {
+			pidFile = proc.Config.PIDFilePath()
+		}
+		// Still our children, so their exit status can be collected
+		go m.supervise(h.Name, proc, done, pidFile, func() error {
+			return m.waitPID(h.PID, h.StartTicks)
+		})
+		m.watchHealth(h.Name, proc, done)
+		m.armWatchdog(h.Name, proc, done)
+		proc.cgroup = m.cgroupPath(h.Name)
+		proc.oomKills = oomKills(proc.cgroup)
+
+		running = append(running, h.Name)
+	}
+
+	m.saveState()
+	return running
+}
+
+// resumeOutput pumps the inherited output pipes of a running service into
+// its log files again, passing every line to onLine if set. The caller must
+// hold m.mu.
+func (m *Manager) resumeOutput(name string, proc *ManagedProcess, stdoutFD, stderrFD int, onLine func(line []byte)) {
+	out := &serviceOutput{onLine: onLine}
+	out.stdout.r = os.NewFile(uintptr(stdoutFD), name+" stdout")
+	out.stderr.r = os.NewFile(uintptr(stderrFD), name+" stderr")
+
+	var err error
+	out.stdout.writer, err = m.logWriter(m.logPath(name, proc.Config.StdoutLog, ".out.log"), proc.Config)
+	if err == nil {
+		out.stderr.writer, err = m.logWriter(m.logPath(name, proc.Config.StderrLog, ".err.log"), proc.Config)
+	}
+	if err != nil {
+		fmt.Printf("Failed to resume output of service %s: %v\n", name, err)
+		out.stdout.r.Close()
+		out.stderr.r.Close()
+		return
+	}
+
+	for _, p := range []outputPipe{out.stdout, out.stderr} {
+		go func(p outputPipe) {
+			defer p.r.Close()
+			logs.Pump(p.r, p.writer, out.onLine)
+		}(p)
+	}
+	proc.output = out
+}
+
+func closeFD(fd int) {
+	if fd != 0 {
+		syscall.Close(fd)
+	}
+}
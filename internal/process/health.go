@@ -0,0 +1,211 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// HealthStatus is the outcome of the health checks of a running service
+type HealthStatus string
+
+const (
+	// HealthStarting means no check has decided yet
+	HealthStarting HealthStatus = "starting"
+	HealthHealthy  HealthStatus = "healthy"
+	// HealthUnhealthy means the last retries checks failed
+	HealthUnhealthy HealthStatus = "unhealthy"
+)
+
+// errUnhealthy is the reason of runs ended for failing health checks
+var errUnhealthy = errors.New("health check failed")
+
+// watchHealth starts the health checks of the run that started along with
+// done. The caller must hold m.mu.
+func (m *Manager) watchHealth(name string, proc *ManagedProcess, done chan struct{}) {
+	proc.health = ""
+	proc.healthFailures = 0
+	if proc.Config.HealthCheck == nil {
+		return
+	}
+	proc.health = HealthStarting
+	go m.runHealthChecks(name, proc, done, proc.Config.HealthCheck)
+}
+
+// runHealthChecks probes a service every interval until its run ends
+func (m *Manager) runHealthChecks(name string, proc *ManagedProcess, done chan struct{}, hc *config.HealthCheck) {
+	started := time.Now()
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		err := m.probe(proc.Config, hc)
+
+		m.mu.Lock()
+		// The run ended while the probe was going
+		if m.processes[name] != proc || proc.done != done || proc.stopping {
+			m.mu.Unlock()
+			return
+		}
+		restart := m.recordHealth(name, proc, hc, err, time.Since(started) < hc.StartPeriod)
+		if restart {
+			proc.failure = fmt.Errorf("%w %d times in a row", errUnhealthy, proc.healthFailures)
+		}
+		m.mu.Unlock()
+
+		if restart {
+			fmt.Printf("Service %s failed %d health checks in a row, restarting\n", name, hc.RestartAfter)
+			if _, err := m.stopService(name, false); err != nil {
+				fmt.Printf("Failed to stop unhealthy service %s: %v\n", name, err)
+			}
+			return
+		}
+	}
+}
+
+// recordHealth updates the health of a service with the result of a probe
+// and reports whether the service should be restarted. The caller must hold
+// m.mu.
+func (m *Manager) recordHealth(name string, proc *ManagedProcess, hc *config.HealthCheck, err error, grace bool) bool {
+	if err == nil {
+		if proc.health == HealthUnhealthy {
+			fmt.Printf("Service %s is healthy again\n", name)
+		}
+		proc.health = HealthHealthy
+		proc.healthFailures = 0
+		if proc.Config.Ready != nil && proc.Config.Ready.HealthCheck {
+			m.markReady(name, proc)
+		}
+		return false
+	}
+
+	// Slow starters get some time before failures count
+	if grace && proc.health == HealthStarting {
+		return false
+	}
+
+	proc.healthFailures++
+	if proc.healthFailures >= hc.Retries && proc.health != HealthUnhealthy {
+		fmt.Printf("Service %s is unhealthy: %v\n", name, err)
+		proc.health = HealthUnhealthy
+	}
+	return hc.RestartAfter > 0 && proc.healthFailures >= hc.RestartAfter
+}
+
+// probe runs a single health check
+func (m *Manager) probe(cfg *config.ServiceConfig, hc *config.HealthCheck) error {
+	switch {
+	case hc.HTTP != "":
+		return probeHTTP(hc)
+	case hc.TCP != "":
+		conn, err := net.DialTimeout("tcp", hc.TCP, hc.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		return m.probeExec(cfg, hc)
+	}
+}
+
+func probeHTTP(hc *config.HealthCheck) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.HTTP, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if hc.ExpectStatus != 0 {
+		if resp.StatusCode != hc.ExpectStatus {
+			return fmt.Errorf("unexpected status %d, want %d", resp.StatusCode, hc.ExpectStatus)
+		}
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// probeExec runs the probe command with the directory, environment and
+// account of the service. Its exit status is collected by the reaper.
+func (m *Manager) probeExec(cfg *config.ServiceConfig, hc *config.HealthCheck) error {
+	argv, err := hc.Command()
+	if err != nil {
+		return err
+	}
+	env, err := cfg.Environment()
+	if err != nil {
+		return err
+	}
+	cred, err := processCredential(cfg)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = cfg.Dir
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: cred}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start probe: %w", err)
+	}
+	pid := cmd.Process.Pid
+	exited := m.reaper.watch(pid)
+	cmd.Process.Release()
+
+	select {
+	case ws := <-exited:
+		return statusError(ws)
+	case <-time.After(hc.Timeout):
+		syscall.Kill(-pid, syscall.SIGKILL)
+		<-exited
+		return fmt.Errorf("probe timed out after %s", hc.Timeout)
+	}
+}
+
+// Health returns the health of a running service with a health check, or ""
+func (m *Manager) Health(name string) HealthStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if proc, exists := m.processes[name]; exists {
+		return proc.health
+	}
+	return ""
+}
+
+// HealthStatuses returns the health of every running service with a health
+// check
+func (m *Manager) HealthStatuses() map[string]HealthStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make(map[string]HealthStatus)
+	for name, proc := range m.processes {
+		if proc.health != "" {
+			result[name] = proc.health
+		}
+	}
+	return result
+}
@@ -0,0 +1,129 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxRuns is the number of runs kept in the history of a service
+const maxRuns = 100
+
+// RunResult tells how a run of a service ended
+type RunResult string
+
+const (
+	// RunSuccess means the process exited with status 0
+	RunSuccess RunResult = "success"
+	// RunFailure means the process exited with an error or was killed
+	RunFailure RunResult = "failure"
+	// RunStopped means the process was stopped on request
+	RunStopped RunResult = "stopped"
+)
+
+// Run is one past execution of a service
+type Run struct {
+	StartedAt time.Time `yaml:"started_at" json:"started_at"`
+	EndedAt   time.Time `yaml:"ended_at" json:"ended_at"`
+	// ExitCode is the exit status, 128+n after signal n, -1 if unknown
+	ExitCode int       `yaml:"exit_code" json:"exit_code"`
+	Result   RunResult `yaml:"result" json:"result"`
+	Error    string    `yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+// Duration returns how long the run took
+func (r Run) Duration() time.Duration {
+	return r.EndedAt.Sub(r.StartedAt)
+}
+
+// newRun describes the run that started at startedAt and just ended with err
+func newRun(startedAt time.Time, err error, stopped bool) Run {
+	run := Run{
+		StartedAt: startedAt,
+		EndedAt:   time.Now(),
+		ExitCode:  ExitCode(err),
+		Result:    RunSuccess,
+	}
+	if errors.Is(err, errExitUnknown) {
+		run.ExitCode = -1
+	}
+	if err != nil {
+		run.Result = RunFailure
+		run.Error = err.Error()
+	}
+	if stopped {
+		run.Result = RunStopped
+	}
+	return run
+}
+
+func (m *Manager) historyPath(name string) string {
+	return filepath.Join(m.historyDir, name+".yaml")
+}
+
+func loadRuns(path string) ([]Run, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read run history: %w", err)
+	}
+
+	var runs []Run
+	if err := yaml.Unmarshal(data, &runs); err != nil {
+		return nil, fmt.Errorf("failed to parse run history: %w", err)
+	}
+	return runs, nil
+}
+
+// appendRun adds a run to the history of a service, dropping the oldest runs
+// beyond maxRuns. It must be called without holding m.mu.
+func (m *Manager) appendRun(name string, run Run) {
+	m.historyMu.Lock()
+	defer m.historyMu.Unlock()
+
+	// The service may have been removed since the run ended
+	m.mu.RLock()
+	_, exists := m.processes[name]
+	m.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	path := m.historyPath(name)
+	runs, err := loadRuns(path)
+	if err != nil {
+		fmt.Printf("Failed to load run history of %s, starting over: %v\n", name, err)
+	}
+
+	// Runs that end close together may be appended out of order
+	i := len(runs)
+	for i > 0 && runs[i-1].EndedAt.After(run.EndedAt) {
+		i--
+	}
+	runs = slices.Insert(runs, i, run)
+	if len(runs) > maxRuns {
+		runs = runs[len(runs)-maxRuns:]
+	}
+	if err := writeFileAtomic(path, runs); err != nil {
+		fmt.Printf("Failed to save run history of %s: %v\n", name, err)
+	}
+}
+
+// Runs returns the run history of a service, oldest first
+func (m *Manager) Runs(name string) ([]Run, error) {
+	m.mu.RLock()
+	_, exists := m.processes[name]
+	m.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("service %s not found", name)
+	}
+	return loadRuns(m.historyPath(name))
+}
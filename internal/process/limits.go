@@ -0,0 +1,202 @@
+package process
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// LimitsShim is the first argument the daemon binary is started with to
+// apply resource limits and then execute a service, see RunLimitsShim
+const LimitsShim = "__eternal_limits"
+
+// rlimitNproc is RLIMIT_NPROC, missing from package syscall
+const rlimitNproc = 6
+
+// resources maps the names of config.Limits to rlimit resources
+var resources = map[string]int{
+	"nofile": syscall.RLIMIT_NOFILE,
+	"nproc":  rlimitNproc,
+	"core":   syscall.RLIMIT_CORE,
+	"as":     syscall.RLIMIT_AS,
+	"stack":  syscall.RLIMIT_STACK,
+	"cpu":    syscall.RLIMIT_CPU,
+}
+
+// procLimitNames maps the rows of /proc/<pid>/limits to the names of
+// config.Limits
+var procLimitNames = map[string]string{
+	"Max open files":     "nofile",
+	"Max processes":      "nproc",
+	"Max core file size": "core",
+	"Max address space":  "as",
+	"Max stack size":     "stack",
+	"Max cpu time":       "cpu",
+}
+
+// applyLimits makes cmd start through the limits shim if the service has
+// resource limits. The shim also takes over switching to cred, so hard
+// limits can still be raised before privileges are dropped.
+func applyLimits(cmd *exec.Cmd, limits *config.Limits, cred *syscall.Credential) error {
+	if limits == nil {
+		return nil
+	}
+	var spec []string
+	limits.Each(func(name string, limit config.Limit) {
+		spec = append(spec, name+"="+limit.String())
+	})
+	if len(spec) == 0 {
+		return nil
+	}
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+
+	var credSpec string
+	if cred != nil {
+		groups := make([]string, len(cred.Groups))
+		for i, gid := range cred.Groups {
+			groups[i] = strconv.FormatUint(uint64(gid), 10)
+		}
+		credSpec = fmt.Sprintf("%d:%d:%s", cred.Uid, cred.Gid, strings.Join(groups, ","))
+		cmd.SysProcAttr.Credential = nil
+	}
+
+	// The forked daemon executes itself, even if its binary was replaced
+	args := append([]string{"eternal-limits", LimitsShim, strings.Join(spec, ","), credSpec, cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = args
+	return nil
+}
+
+// RunLimitsShim applies the resource limits and credentials passed by
+// applyLimits and executes the service. It does not return.
+func RunLimitsShim(args []string) {
+	if err := limitsShim(args); err != nil {
+		fmt.Fprintf(os.Stderr, "eternal: %v\n", err)
+		os.Exit(127)
+	}
+}
+
+func limitsShim(args []string) error {
+	if len(args) < 4 {
+		return fmt.Errorf("invalid limits shim arguments")
+	}
+	spec, credSpec, path, argv := args[0], args[1], args[2], args[3:]
+
+	for _, entry := range strings.Split(spec, ",") {
+		name, value, _ := strings.Cut(entry, "=")
+		limit, err := config.ParseLimit(value)
+		if err != nil {
+			return err
+		}
+		rlimit := syscall.Rlimit{Cur: limit.Soft, Max: limit.Hard}
+		if err := syscall.Setrlimit(resources[name], &rlimit); err != nil {
+			return fmt.Errorf("failed to set limit %s to %s: %w", name, limit, err)
+		}
+	}
+
+	if credSpec != "" {
+		if err := switchCredential(credSpec); err != nil {
+			return err
+		}
+	}
+
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+// switchCredential drops to the uid:gid:groups passed by applyLimits
+func switchCredential(spec string) error {
+	fields := strings.SplitN(spec, ":", 3)
+	if len(fields) != 3 {
+		return fmt.Errorf("invalid credential: %s", spec)
+	}
+	uid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid credential: %s", spec)
+	}
+	gid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return fmt.Errorf("invalid credential: %s", spec)
+	}
+	var groups []int
+	for _, g := range strings.Split(fields[2], ",") {
+		if g == "" {
+			continue
+		}
+		id, err := strconv.Atoi(g)
+		if err != nil {
+			return fmt.Errorf("invalid credential: %s", spec)
+		}
+		groups = append(groups, id)
+	}
+
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set gid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set uid: %w", err)
+	}
+	return nil
+}
+
+// processLimits reads the effective resource limits of a process
+func processLimits(pid int) (map[string]config.Limit, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/limits", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	limits := make(map[string]config.Limit)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Rows are "Max open files            1024     4096     files"
+		line := scanner.Text()
+		if len(line) < 26 {
+			continue
+		}
+		name, ok := procLimitNames[strings.TrimSpace(line[:26])]
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(line[26:])
+		if len(fields) < 2 {
+			continue
+		}
+		limit, err := config.ParseLimit(fields[0] + ":" + fields[1])
+		if err != nil {
+			continue
+		}
+		limits[name] = limit
+	}
+	return limits, scanner.Err()
+}
+
+// Limits returns the effective resource limits of a running service
+func (m *Manager) Limits(name string) (map[string]config.Limit, error) {
+	m.mu.RLock()
+	proc, exists := m.processes[name]
+	var pid int
+	if exists {
+		pid = proc.PID
+	}
+	m.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("service %s not found", name)
+	}
+	if pid == 0 {
+		return nil, nil
+	}
+	return processLimits(pid)
+}
@@ -2,32 +2,109 @@ package process
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Magnetkopf/Eternal/internal/config"
+	"github.com/Magnetkopf/Eternal/internal/logs"
 )
 
 // ProcessStatus represents the state of a process
 type ProcessStatus string
 
 const (
-	StatusRunning ProcessStatus = "running"
-	StatusStopped ProcessStatus = "stopped"
-	StatusError   ProcessStatus = "error"
+	// StatusStarting means the process runs but is not ready yet
+	StatusStarting ProcessStatus = "starting"
+	StatusRunning  ProcessStatus = "running"
+	StatusStopped  ProcessStatus = "stopped"
+	StatusError    ProcessStatus = "error"
+	// StatusCrashLoop means the service hit its start limit and will not be
+	// restarted until it is reset
+	StatusCrashLoop ProcessStatus = "crash-loop"
+	// StatusSucceeded means a oneshot service exited successfully
+	StatusSucceeded ProcessStatus = "succeeded"
 )
 
+// StopResult describes how a stopped service went down
+type StopResult string
+
+const (
+	// StopGraceful means the process exited after the stop signal
+	StopGraceful StopResult = "graceful"
+	// StopKilled means the process ignored the stop signal and was killed
+	StopKilled StopResult = "killed"
+)
+
+// killTimeout is how long to wait for a process to disappear after SIGKILL
+const killTimeout = 5 * time.Second
+
 // ManagedProcess holds the state of a single service
 type ManagedProcess struct {
 	Config *config.ServiceConfig
-	Cmd    *exec.Cmd
+	// PID of the main process while it is running, 0 otherwise
+	PID    int
 	Status ProcessStatus
 	Err    error
+
+	// stopping is set by StopService so the exit is not treated as a crash
+	stopping bool
+	// done is closed once the current process has exited
+	done chan struct{}
+	// ready is closed once the current process is ready
+	ready chan struct{}
+	// restartTimer is the pending automatic restart, if any
+	restartTimer *time.Timer
+	// startedAt is when the current or last process was started
+	startedAt time.Time
+	// starts holds recent start times for the start limit
+	starts []time.Time
+	// backoff counts consecutive automatic restarts
+	backoff int
+	// seq orders processes by the time they were started
+	seq uint64
+	// startTicks is the kernel start time of PID, to tell it from a reused PID
+	startTicks uint64
+	// pgid is the process group of PID
+	pgid int
+	// launching is set while the launcher of a forking service runs
+	launching bool
+	// scheduleTimer fires at nextRun for services with a schedule
+	scheduleTimer *time.Timer
+	nextRun       time.Time
+	// scheduleArm numbers the arming of scheduleTimer
+	scheduleArm uint64
+	// queued is set when a scheduled run waits for the previous one
+	queued bool
+	// health is the outcome of the health checks of the current run
+	health         HealthStatus
+	healthFailures int
+	// failure is set when the daemon stops the current run because it is
+	// failing, the run then counts as a failed one
+	failure error
+	// output holds the pipes of the current or last process
+	output *serviceOutput
+	// notify is the socket receiving sd_notify style messages, if used
+	notify *net.UnixConn
+	// watchdog fires when the service missed its keep-alive ping
+	watchdog *time.Timer
+	// cgroup is the cgroup of the current run, if cgroups are used
+	cgroup string
+	// oomKills is the OOM kill count of cgroup when the run started
+	oomKills uint64
+	// cpuSample is the CPU time at the last call of Stats
+	cpuSample cpuSample
+	// restarts counts automatic restarts since the daemon started
+	restarts uint64
+	// lastRun is the most recent entry of the run history, if loaded
+	lastRun *Run
+	// historyLoaded tells whether lastRun reflects the run history
+	historyLoaded bool
 }
 
 // Manager handles multiple services
@@ -35,16 +112,63 @@ type Manager struct {
 	processes   map[string]*ManagedProcess
 	mu          sync.RWMutex
 	servicesDir string
+	stoppedFile string
+	stateFile   string
+	logsDir     string
+	historyDir  string
+	// historyMu serializes writes to the run history files, which happen
+	// without holding mu
+	historyMu sync.Mutex
+	notifyDir string
+	// outputDir holds the FIFOs the services write their output to
+	outputDir string
+	// logWriters holds one open writer per log file, shared across restarts
+	logWriters map[string]*logs.Writer
+	system     config.SystemConfig
+	// startSeq is the sequence number of the last started process
+	startSeq uint64
+	// shuttingDown disables starts and automatic restarts
+	shuttingDown bool
+	reaper       *reaper
+	// onExit is told about services that exited and stay down
+	onExit ExitHandler
+	// cgroupBase is the delegated cgroup of the daemon, if set up
+	cgroupBase string
+	// cgroupDir holds the cgroups of the services, if set up
+	cgroupDir string
+	// controllers are the cgroup controllers enabled for the services
+	controllers map[string]bool
 }
 
-// NewManager creates a new process manager
-func NewManager(servicesDir string) *Manager {
+// ExitHandler is called when a service exited on its own, or failed to
+// start, and is not going to be restarted. It runs with the manager locked
+// and must not call back into it.
+type ExitHandler func(name string, exitErr error)
+
+// NewManager creates a new process manager rooted at the eternal base directory
+func NewManager(baseDir string, system config.SystemConfig) *Manager {
 	return &Manager{
+		system:      system,
 		processes:   make(map[string]*ManagedProcess),
-		servicesDir: servicesDir,
+		servicesDir: filepath.Join(baseDir, "services"),
+		stoppedFile: filepath.Join(baseDir, "stopped.yaml"),
+		stateFile:   filepath.Join(baseDir, "state.yaml"),
+		logsDir:     filepath.Join(baseDir, "logs"),
+		historyDir:  filepath.Join(baseDir, "history"),
+		notifyDir:   filepath.Join(baseDir, "notify"),
+		outputDir:   filepath.Join(baseDir, "output"),
+		logWriters:  make(map[string]*logs.Writer),
+		reaper:      newReaper(),
 	}
 }
 
+// SetExitHandler installs the handler for services that went down for good
+func (m *Manager) SetExitHandler(h ExitHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onExit = h
+}
+
 // LoadServices scans the services directory and loads configurations
 func (m *Manager) LoadServices() error {
 	m.mu.Lock()
@@ -74,144 +198,430 @@ func (m *Manager) LoadServices() error {
 		// Only add if not already running/exists, or update?
 		// For now, simpler: just add.
 		if _, exists := m.processes[name]; !exists {
-			m.processes[name] = &ManagedProcess{
-				Config: cfg,
-				Status: StatusStopped,
-			}
+			m.addService(name, cfg)
 		}
 	}
+
+	// Report cycles early, starting the affected services fails
+	if _, err := config.NewDependencyGraph(m.configsLocked()); err != nil {
+		return err
+	}
 	return nil
 }
 
-// StartService starts a service by name
+// configsLocked returns the configuration of every service. The caller must
+// hold m.mu.
+func (m *Manager) configsLocked() map[string]*config.ServiceConfig {
+	configs := make(map[string]*config.ServiceConfig)
+	for name, proc := range m.processes {
+		configs[name] = proc.Config
+	}
+	return configs
+}
+
+// addService registers a loaded service. The caller must hold m.mu.
+func (m *Manager) addService(name string, cfg *config.ServiceConfig) *ManagedProcess {
+	proc := &ManagedProcess{
+		Config: cfg,
+		Status: StatusStopped,
+	}
+	m.processes[name] = proc
+	m.armSchedule(name, proc)
+	return proc
+}
+
+// loadServiceLocked returns a service, loading its configuration from disk
+// if it was created after the daemon started. The caller must hold m.mu.
+func (m *Manager) loadServiceLocked(name string) (*ManagedProcess, error) {
+	if proc, exists := m.processes[name]; exists {
+		return proc, nil
+	}
+	cfgPath := filepath.Join(m.servicesDir, name+".yaml")
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		return nil, fmt.Errorf("service %s not found (and failed to load config: %v)", name, err)
+	}
+	return m.addService(name, cfg), nil
+}
+
+// StartService starts a service by name, along with the services it
+// requires or wants that are not running yet
 func (m *Manager) StartService(name string) error {
+	return m.StartServices([]string{name}, false)[name]
+}
+
+// StartServiceWait starts a service like StartService and waits until it is
+// ready, or for oneshot services, until it finished
+func (m *Manager) StartServiceWait(name string) error {
+	return m.StartServices([]string{name}, true)[name]
+}
+
+// startOne starts a single service. A dependency that is already running
+// counts as started, a requested service does not.
+func (m *Manager) startOne(name string, requested bool) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	proc, exists := m.processes[name]
-	if !exists {
-		// Try to load it from disk if not found in memory
-		// This handles the case where a service file was created after daemon start
-		cfgPath := filepath.Join(m.servicesDir, name+".yaml")
-		cfg, err := config.LoadConfig(cfgPath)
-		if err != nil {
-			return fmt.Errorf("service %s not found (and failed to load config: %v)", name, err)
-		}
+	if m.shuttingDown {
+		return fmt.Errorf("daemon is shutting down")
+	}
 
-		proc = &ManagedProcess{
-			Config: cfg,
-			Status: StatusStopped,
-		}
-		m.processes[name] = proc
+	proc, err := m.loadServiceLocked(name)
+	if err != nil {
+		return err
 	}
 
-	if proc.Status == StatusRunning {
+	if proc.active() {
+		if !requested {
+			return nil
+		}
 		return fmt.Errorf("service %s is already running", name)
 	}
+	if proc.Status == StatusCrashLoop {
+		return fmt.Errorf("service %s is in crash-loop, reset it first", name)
+	}
+
+	// A manual start supersedes any pending automatic restart
+	proc.cancelRestart()
+	proc.backoff = 0
+
+	if proc.Config.Restart == config.RestartUnlessStopped {
+		if err := config.UnmarkServiceStopped(m.stoppedFile, name); err != nil {
+			fmt.Printf("Failed to clear stopped state of %s: %v\n", name, err)
+		}
+	}
 
-	// Parse command line
-	parts := strings.Fields(proc.Config.Exec)
-	if len(parts) == 0 {
-		return fmt.Errorf("empty exec command")
+	return m.startLocked(name, proc)
+}
+
+// startLocked spawns the process of a service. The caller must hold m.mu.
+func (m *Manager) startLocked(name string, proc *ManagedProcess) error {
+	argv, err := proc.Config.Command()
+	if err != nil {
+		proc.Status = StatusError
+		proc.Err = err
+		return err
 	}
 
-	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd := exec.Command(argv[0], argv[1:]...)
 	if proc.Config.Dir != "" {
 		cmd.Dir = proc.Config.Dir
 	}
 
-	// Optional: Set stdout/stderr to something useful or /dev/null
-	// For now, let's inherit or ignore. Daemon usually logs to file.
-	// We'll leave it attached to nil (os.DevNull) for now.
+	env, err := proc.Config.Environment()
+	if err != nil {
+		proc.Status = StatusError
+		proc.Err = err
+		return err
+	}
+	if usesNotify(proc) {
+		path, err := m.listenNotify(name, proc)
+		if err != nil {
+			proc.Status = StatusError
+			proc.Err = err
+			return err
+		}
+		env = append(env, notifyEnv+"="+path)
+		env = append(env, watchdogEnv(proc)...)
+	}
+	cmd.Env = env
+
+	// Run in a dedicated process group so the whole service can be signalled
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	cred, err := processCredential(proc.Config)
+	if err != nil {
+		proc.Status = StatusError
+		proc.Err = err
+		return err
+	}
+	cmd.SysProcAttr.Credential = cred
+
+	if err := applyLimits(cmd, proc.Config.Limits, cred); err != nil {
+		proc.Status = StatusError
+		proc.Err = err
+		return err
+	}
+
+	cgroup, err := m.prepareCgroup(name, proc.Config)
+	if err != nil {
+		proc.Status = StatusError
+		proc.Err = err
+		return err
+	}
+	if cgroup != "" {
+		fd, err := openCgroup(cgroup)
+		if err != nil {
+			proc.Status = StatusError
+			proc.Err = err
+			return err
+		}
+		defer syscall.Close(fd)
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = fd
+	}
+
+	output, err := m.openOutput(name, proc.Config)
+	if err != nil {
+		proc.Status = StatusError
+		proc.Err = err
+		return err
+	}
+	cmd.Stdout = output.stdout.w
+	cmd.Stderr = output.stderr.w
+	done := make(chan struct{})
+	output.onLine = m.readyLogMatcher(name, proc, done)
+
+	proc.startedAt = time.Now()
+	proc.starts = append(proc.starts, proc.startedAt)
+	proc.cgroup = cgroup
+	proc.oomKills = oomKills(cgroup)
 
 	if err := cmd.Start(); err != nil {
+		output.abort()
 		proc.Status = StatusError
 		proc.Err = err
 		return fmt.Errorf("failed to start: %w", err)
 	}
-
-	proc.Cmd = cmd
+	output.attach()
+	proc.output = output
+
+	// The reaper collects the exit status instead of cmd.Wait
+	pid := cmd.Process.Pid
+	exited := m.reaper.watch(pid)
+	cmd.Process.Release()
+
+	m.startSeq++
+	proc.seq = m.startSeq
+	proc.PID = pid
+	proc.startTicks, _ = processStartTicks(proc.PID)
+	proc.pgid = pid
 	proc.Status = StatusRunning
 	proc.Err = nil
-
-	// Defunct process handling:
-	// In a real system, we'd want to Wait() for the process in a goroutine
-	// to update status when it dies.
-	go func() {
-		err := cmd.Wait()
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		// Check if it's still the same process (it might have been restarted)
-		if m.processes[name] == proc {
-			proc.Status = StatusStopped
-			if err != nil {
-				proc.Err = err
-				proc.Status = StatusError
-			}
-		}
-	}()
+	proc.stopping = false
+	proc.failure = nil
+	proc.done = done
+	m.awaitReady(name, proc, done)
+	m.watchHealth(name, proc, done)
+	m.armWatchdog(name, proc, done)
+	m.saveState()
+
+	var pidFile string
+	if proc.Config.Type == config.ServiceForking {
+		pidFile = proc.Config.PIDFilePath()
+	}
+	proc.launching = pidFile != ""
+	go m.supervise(name, proc, done, pidFile, func() error {
+		return statusError(<-exited)
+	})
 
 	return nil
 }
 
-// StopService stops a service and waits for it to exit
-func (m *Manager) StopService(name string) error {
-	// Use an anonymous function to hold the lock for the critical section only
-	err := func() error {
-		m.mu.Lock()
-		defer m.mu.Unlock()
+// processExited records the exit of the process started along with done and
+// applies the restart policy
+func (m *Manager) processExited(name string, proc *ManagedProcess, done chan struct{}, err error) {
+	defer close(done)
+	if run := m.exited(name, proc, done, err); run != nil {
+		m.appendRun(name, *run)
+	}
+}
 
-		proc, exists := m.processes[name]
-		if !exists {
-			return fmt.Errorf("service %s not found", name)
-		}
+// exited updates the service after the exit of the process started along
+// with done. It returns the run to add to the history, nil if the process is
+// no longer the current one.
+func (m *Manager) exited(name string, proc *ManagedProcess, done chan struct{}, err error) *Run {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		if proc.Status != StatusRunning || proc.Cmd == nil || proc.Cmd.Process == nil {
-			return fmt.Errorf("service %s is not running", name)
-		}
+	// Check if it's still the same process (it might have been restarted)
+	if m.processes[name] != proc || proc.done != done {
+		return nil
+	}
+	proc.PID = 0
+	proc.health = ""
+	proc.stopWatchdog()
+	defer m.saveState()
+
+	// The kernel killed a process of the service for running out of memory
+	if err != nil && oomKills(proc.cgroup) > proc.oomKills {
+		err = fmt.Errorf("%w (%w)", errOOMKill, err)
+	}
 
-		// Try graceful stop (SIGTERM)
-		if runtime.GOOS != "windows" {
-			if err := proc.Cmd.Process.Signal(os.Interrupt); err != nil {
-				// Fallback to Kill
-				proc.Cmd.Process.Kill()
-			}
+	// Stopped by the daemon for failing, keep the exit status as the cause
+	if proc.failure != nil {
+		if err != nil {
+			err = fmt.Errorf("%w (%w)", proc.failure, err)
 		} else {
-			proc.Cmd.Process.Kill()
+			err = proc.failure
 		}
-		return nil
-	}()
+		proc.failure = nil
+		proc.stopping = false
+	}
+	run := newRun(proc.startedAt, err, proc.stopping)
+	proc.lastRun = &run
+	proc.historyLoaded = true
+
+	if proc.stopping {
+		// Stopped on request, whatever the exit status says
+		proc.stopping = false
+		proc.Status = StatusStopped
+		proc.Err = nil
+		proc.queued = false
+		return &run
+	}
 
+	proc.Status = StatusStopped
 	if err != nil {
-		return err
+		proc.Err = err
+		proc.Status = StatusError
+	} else if proc.Config.Type == config.ServiceOneshot {
+		proc.Status = StatusSucceeded
 	}
 
-	// Wait for the service to actually stop
-	// The lock is already released by the anonymous function's defer
-	for i := 0; i < 50; i++ {
-		m.mu.RLock()
-		p, exists := m.processes[name]
-		status := p.Status
-		m.mu.RUnlock()
+	m.handleExit(name, proc, err)
+	m.startQueued(name, proc)
+	return &run
+}
+
+// StopService stops a service and waits for it to exit. The configured stop
+// signal is sent first; if the process is still alive after stop_timeout it
+// is killed with SIGKILL.
+func (m *Manager) StopService(name string) (StopResult, error) {
+	return m.stopService(name, true)
+}
 
-		if !exists {
-			// Removed? Treated as stopped
-			return nil
+// stopService implements StopService. byUser tells whether the stop counts as
+// an explicit user stop for unless-stopped services.
+func (m *Manager) stopService(name string, byUser bool) (StopResult, error) {
+	m.mu.Lock()
+	proc, exists := m.processes[name]
+	if !exists {
+		m.mu.Unlock()
+		return "", fmt.Errorf("service %s not found", name)
+	}
+
+	if byUser {
+		// The user's stop wins over a failure the daemon is acting on
+		proc.failure = nil
+	}
+	if byUser && proc.Config.Restart == config.RestartUnlessStopped {
+		if err := config.MarkServiceStopped(m.stoppedFile, name); err != nil {
+			fmt.Printf("Failed to record stopped state of %s: %v\n", name, err)
 		}
-		if status != StatusRunning {
-			return nil
+	}
+
+	if !proc.active() || proc.PID == 0 {
+		// A service waiting to be restarted counts as running for the user
+		cancelled := proc.cancelRestart()
+		m.mu.Unlock()
+		if cancelled {
+			return StopGraceful, nil
 		}
-		time.Sleep(100 * time.Millisecond)
+		return "", fmt.Errorf("service %s is not running", name)
 	}
 
-	return fmt.Errorf("service failed to stop in time")
+	proc.stopping = true
+	pid := proc.PID
+	pgid := proc.pgid
+	done := proc.done
+	mode := proc.Config.KillMode
+	deadline := time.Now().Add(proc.Config.StopTimeout)
+	sig, err := config.ParseSignal(proc.Config.StopSignal)
+	if err != nil {
+		sig = syscall.SIGTERM
+	}
+	// The lock must not be held while waiting, the exit handler needs it
+	m.mu.Unlock()
+
+	if err := signalService(pid, pgid, mode, sig); err != nil {
+		// Most likely the process exited on its own in the meantime
+		deadline = time.Now()
+	}
+	select {
+	case <-done:
+		if mode == config.KillProcess || !groupAlive(pgid) {
+			return StopGraceful, nil
+		}
+		// The main process is gone, give the rest of the group the remaining time
+		for time.Now().Before(deadline) && groupAlive(pgid) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if !groupAlive(pgid) {
+			return StopGraceful, nil
+		}
+		fmt.Printf("Processes of service %s did not stop within %s, sending SIGKILL\n", name, proc.Config.StopTimeout)
+		signalService(pid, pgid, mode, syscall.SIGKILL)
+		return StopKilled, nil
+	case <-time.After(time.Until(deadline)):
+		fmt.Printf("Service %s did not stop within %s, sending SIGKILL\n", name, proc.Config.StopTimeout)
+	}
+
+	signalService(pid, pgid, mode, syscall.SIGKILL)
+	select {
+	case <-done:
+		return StopKilled, nil
+	case <-time.After(killTimeout):
+		return StopKilled, fmt.Errorf("service %s did not exit after SIGKILL", name)
+	}
 }
 
-// RemoveService removes a service from the manager
+// RemoveService removes a service from the manager and closes its log files
 func (m *Manager) RemoveService(name string) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	proc, exists := m.processes[name]
+	if exists {
+		proc.cancelRestart()
+		if proc.scheduleTimer != nil {
+			proc.scheduleTimer.Stop()
+		}
+		proc.stopWatchdog()
+		m.closeNotify(name, proc)
+		m.removeCgroup(name)
+	}
 	delete(m.processes, name)
+	if exists {
+		m.closeLogWriters(name, proc.Config)
+		os.Remove(m.outputPath(name, ".out"))
+		os.Remove(m.outputPath(name, ".err"))
+	}
+	m.saveState()
+	config.UnmarkServiceStopped(m.stoppedFile, name)
+	m.mu.Unlock()
+
+	// Taking historyMu keeps a run recorded meanwhile from bringing the file
+	// back
+	m.historyMu.Lock()
+	defer m.historyMu.Unlock()
+	m.mu.RLock()
+	_, readded := m.processes[name]
+	m.mu.RUnlock()
+	if !readded {
+		os.Remove(m.historyPath(name))
+	}
+}
+
+// StoppedByUser reports whether an unless-stopped service was last stopped
+// explicitly, in which case it should not be started automatically
+func (m *Manager) StoppedByUser(name string) bool {
+	m.mu.RLock()
+	proc, exists := m.processes[name]
+	m.mu.RUnlock()
+
+	if !exists || proc.Config.Restart != config.RestartUnlessStopped {
+		return false
+	}
+
+	stopped, err := config.LoadStoppedServices(m.stoppedFile)
+	if err != nil {
+		return false
+	}
+	for _, s := range stopped {
+		if s == name {
+			return true
+		}
+	}
+	return false
 }
 
 // GetStatus returns the status of a service
@@ -226,6 +636,17 @@ func (m *Manager) GetStatus(name string) (ProcessStatus, error) {
 	return proc.Status, nil
 }
 
+// PID returns the main PID of a running service, 0 otherwise
+func (m *Manager) PID(name string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if proc, exists := m.processes[name]; exists {
+		return proc.PID
+	}
+	return 0
+}
+
 // RestartService restarts a service, or returns error if not running
 func (m *Manager) RestartService(name string) error {
 	m.mu.RLock()
@@ -236,35 +657,14 @@ func (m *Manager) RestartService(name string) error {
 		return fmt.Errorf("service %s not found", name)
 	}
 
-	if proc.Status != StatusRunning {
+	if !proc.active() {
 		return fmt.Errorf("not started")
 	}
 
-	if err := m.StopService(name); err != nil {
+	if _, err := m.StopService(name); err != nil {
 		return fmt.Errorf("failed to stop: %w", err)
 	}
 
-	// Wait for the service to actually stop
-	for i := 0; i < 50; i++ {
-		status, err := m.GetStatus(name)
-		if err != nil {
-			return err
-		}
-		if status != StatusRunning {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
-
-	// Double check
-	status, err := m.GetStatus(name)
-	if err != nil {
-		return err
-	}
-	if status == StatusRunning {
-		return fmt.Errorf("service failed to stop in time")
-	}
-
 	if err := m.StartService(name); err != nil {
 		return fmt.Errorf("failed to start: %w", err)
 	}
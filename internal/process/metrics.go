@@ -0,0 +1,93 @@
+package process
+
+import (
+	"sort"
+	"time"
+)
+
+// ServiceMetrics is the state of a service as exported to monitoring
+type ServiceMetrics struct {
+	Name   string
+	Status ProcessStatus
+	Health HealthStatus
+	// StartedAt is when the current process was started, zero if it is not
+	// running
+	StartedAt time.Time
+	// Restarts counts automatic restarts since the daemon started
+	Restarts uint64
+	// LastRun is the most recent finished run, nil if there is none
+	LastRun *Run
+	// Usage is the resource usage of a running service. CPUPercent is not
+	// set.
+	Usage *Stats
+	// CgroupCPUSeconds is the CPU time used in the cgroup of the service
+	// over all its runs, nil without a cgroup. Unlike Usage.CPUSeconds it
+	// never decreases.
+	CgroupCPUSeconds *float64
+}
+
+// Metrics returns the state of every service, ordered by name
+func (m *Manager) Metrics() []ServiceMetrics {
+	type sample struct {
+		pid, pgid int
+		cgroup    string
+		// cpuCgroup is the cgroup of the service, also when it is not running
+		cpuCgroup string
+	}
+	m.mu.RLock()
+	list := make([]ServiceMetrics, 0, len(m.processes))
+	samples := make([]sample, 0, len(m.processes))
+	var unloaded []int
+	for name, proc := range m.processes {
+		entry := ServiceMetrics{
+			Name:     name,
+			Status:   proc.Status,
+			Health:   proc.health,
+			Restarts: proc.restarts,
+			LastRun:  proc.lastRun,
+		}
+		if proc.PID != 0 {
+			entry.StartedAt = proc.startedAt
+		}
+		if !proc.historyLoaded {
+			unloaded = append(unloaded, len(list))
+		}
+		list = append(list, entry)
+		samples = append(samples, sample{proc.PID, proc.pgid, proc.cgroup, m.cgroupPath(name)})
+	}
+	m.mu.RUnlock()
+
+	// The history is read once, afterwards exited keeps lastRun current
+	for _, i := range unloaded {
+		runs, err := loadRuns(m.historyPath(list[i].Name))
+		if err != nil {
+			continue
+		}
+		m.mu.Lock()
+		if proc, exists := m.processes[list[i].Name]; exists {
+			// A run that ended meanwhile is newer than the file read
+			if !proc.historyLoaded && len(runs) > 0 {
+				proc.lastRun = &runs[len(runs)-1]
+			}
+			proc.historyLoaded = true
+			list[i].LastRun = proc.lastRun
+		}
+		m.mu.Unlock()
+	}
+
+	// Reading /proc takes a while, so it happens without the lock
+	for i, s := range samples {
+		if s.pid != 0 {
+			list[i].Usage, _ = sampleUsage(s.pid, s.pgid, s.cgroup)
+			list[i].Usage.Uptime = time.Since(list[i].StartedAt)
+		}
+		if s.cpuCgroup != "" {
+			if seconds, ok := cgroupCPUSeconds(s.cpuCgroup); ok {
+				list[i].CgroupCPUSeconds = &seconds
+			}
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
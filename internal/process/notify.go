@@ -0,0 +1,144 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// notifyEnv is the variable telling a service where to send sd_notify
+// style messages
+const notifyEnv = "NOTIFY_SOCKET"
+
+// usesNotify reports whether a service talks to the daemon over its notify
+// socket
+func usesNotify(proc *ManagedProcess) bool {
+	return (proc.Config.Ready != nil && proc.Config.Ready.Notify) || proc.Config.WatchdogSec > 0
+}
+
+// listenNotify opens the notify socket of a service, unless it is open
+// already, and returns its path. The socket is bound to a path, so services
+// keep reaching it across daemon restarts and upgrades. The caller must hold
+// m.mu.
+func (m *Manager) listenNotify(name string, proc *ManagedProcess) (string, error) {
+	path := filepath.Join(m.notifyDir, name+".sock")
+	if proc.notify != nil {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(m.notifyDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create notify directory: %w", err)
+	}
+	// Left behind by an earlier daemon instance
+	os.Remove(path)
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return "", fmt.Errorf("failed to open notify socket: %w", err)
+	}
+	// Senders are identified by their credentials, so services running as
+	// another user may write to it
+	if err := os.Chmod(path, 0666); err != nil {
+		conn.Close()
+		return "", fmt.Errorf("failed to open notify socket: %w", err)
+	}
+	if err := passCredentials(conn); err != nil {
+		conn.Close()
+		return "", fmt.Errorf("failed to open notify socket: %w", err)
+	}
+
+	proc.notify = conn
+	go m.receiveNotify(name, proc, conn)
+	return path, nil
+}
+
+// passCredentials makes the kernel attach the credentials of the sender to
+// every message
+func passCredentials(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// closeNotify closes the notify socket of a service. The caller must hold
+// m.mu.
+func (m *Manager) closeNotify(name string, proc *ManagedProcess) {
+	if proc.notify == nil {
+		return
+	}
+	proc.notify.Close()
+	proc.notify = nil
+	os.Remove(filepath.Join(m.notifyDir, name+".sock"))
+}
+
+// receiveNotify handles the messages sent to the notify socket of a service
+// until it is closed
+func (m *Manager) receiveNotify(name string, proc *ManagedProcess, conn *net.UnixConn) {
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofUcred))
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return
+		}
+		pid := senderPID(oob[:oobn])
+
+		m.mu.Lock()
+		if m.processes[name] == proc && proc.notify == conn && proc.sentBy(pid) {
+			m.handleNotify(name, proc, buf[:n])
+		}
+		m.mu.Unlock()
+	}
+}
+
+// senderPID returns the PID from the credentials of a message, or 0
+func senderPID(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		if cred, err := syscall.ParseUnixCredentials(&msg); err == nil {
+			return int(cred.Pid)
+		}
+	}
+	return 0
+}
+
+// sentBy reports whether pid is the main process of the service or in its
+// process group. The caller must hold m.mu.
+func (p *ManagedProcess) sentBy(pid int) bool {
+	if pid <= 0 || p.PID == 0 {
+		return false
+	}
+	return pid == p.PID || processGroup(pid) == p.pgid
+}
+
+// handleNotify applies a notify message, newline separated VARIABLE=value
+// assignments. Unknown assignments are ignored. The caller must hold m.mu.
+func (m *Manager) handleNotify(name string, proc *ManagedProcess, msg []byte) {
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		switch string(line) {
+		case "READY=1":
+			if proc.Config.Ready != nil && proc.Config.Ready.Notify {
+				m.markReady(name, proc)
+			}
+		case "WATCHDOG=1":
+			proc.feedWatchdog()
+		case "WATCHDOG=trigger":
+			m.watchdogExpired(name, proc, proc.done)
+		}
+	}
+}
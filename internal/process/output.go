@@ -0,0 +1,214 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+	"github.com/Magnetkopf/Eternal/internal/logs"
+)
+
+// outputPipe is a FIFO from a service output stream to its log writer
+type outputPipe struct {
+	r, w   *os.File
+	writer *logs.Writer
+}
+
+// serviceOutput holds the pipes for stdout and stderr of one process
+type serviceOutput struct {
+	stdout, stderr outputPipe
+	// onLine is passed every line of output, if set
+	onLine func(line []byte)
+}
+
+// LogPaths returns the stdout and stderr log files of a service
+func (m *Manager) LogPaths(name string) (string, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	proc, exists := m.processes[name]
+	if !exists {
+		return "", "", fmt.Errorf("service %s not found", name)
+	}
+	return m.logPath(name, proc.Config.StdoutLog, ".out.log"), m.logPath(name, proc.Config.StderrLog, ".err.log"), nil
+}
+
+func (m *Manager) logPath(name, configured, suffix string) string {
+	if configured == "" {
+		return filepath.Join(m.logsDir, name+suffix)
+	}
+	if !filepath.IsAbs(configured) {
+		return filepath.Join(m.logsDir, configured)
+	}
+	return configured
+}
+
+// logWriter returns the shared writer for a log file, opening it on first use.
+// The caller must hold m.mu.
+func (m *Manager) logWriter(path string, cfg *config.ServiceConfig) (*logs.Writer, error) {
+	rotation := cfg.LogConfig.Merge(m.system.LogConfig)
+	opts := logs.RotateOptions{
+		MaxSize:  int64(rotation.LogMaxSize),
+		MaxFiles: rotation.LogMaxFiles,
+		MaxAge:   rotation.LogMaxAge,
+		Compress: rotation.LogCompress != nil && *rotation.LogCompress,
+	}
+
+	if w, ok := m.logWriters[path]; ok {
+		// Pick up configuration changes since the file was opened
+		w.SetOptions(opts)
+		return w, nil
+	}
+	w, err := logs.NewWriter(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	m.logWriters[path] = w
+	return w, nil
+}
+
+// closeLogWriters closes the writers of a removed service, except for log
+// files another service writes to as well. The caller must hold m.mu and
+// have removed the service from m.processes.
+func (m *Manager) closeLogWriters(name string, cfg *config.ServiceConfig) {
+	inUse := make(map[string]bool)
+	for other, proc := range m.processes {
+		inUse[m.logPath(other, proc.Config.StdoutLog, ".out.log")] = true
+		inUse[m.logPath(other, proc.Config.StderrLog, ".err.log")] = true
+	}
+	for _, path := range []string{m.logPath(name, cfg.StdoutLog, ".out.log"), m.logPath(name, cfg.StderrLog, ".err.log")} {
+		if w, ok := m.logWriters[path]; ok && !inUse[path] {
+			w.Close()
+			delete(m.logWriters, path)
+		}
+	}
+}
+
+// openOutput creates the pipes that capture the output of a service.
+// The caller must hold m.mu.
+func (m *Manager) openOutput(name string, cfg *config.ServiceConfig) (*serviceOutput, error) {
+	stdoutWriter, err := m.logWriter(m.logPath(name, cfg.StdoutLog, ".out.log"), cfg)
+	if err != nil {
+		return nil, err
+	}
+	stderrWriter, err := m.logWriter(m.logPath(name, cfg.StderrLog, ".err.log"), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &serviceOutput{}
+	out.stdout.writer = stdoutWriter
+	out.stderr.writer = stderrWriter
+
+	if out.stdout.r, out.stdout.w, err = m.openFIFO(m.outputPath(name, ".out")); err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	if out.stderr.r, out.stderr.w, err = m.openFIFO(m.outputPath(name, ".err")); err != nil {
+		out.stdout.r.Close()
+		out.stdout.w.Close()
+		return nil, fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+	return out, nil
+}
+
+// outputPath returns the FIFO a service writes the given stream to
+func (m *Manager) outputPath(name, suffix string) string {
+	return filepath.Join(m.outputDir, name+suffix)
+}
+
+// openFIFO creates a new FIFO at path and opens its ends: r for the daemon,
+// w for the service. The service's end is opened for reading as well, so the
+// FIFO never lacks a reader and the service does not get SIGPIPE while no
+// daemon is running; it blocks once the FIFO is full instead. A restarted
+// daemon opens the FIFO again by its path.
+func (m *Manager) openFIFO(path string) (r, w *os.File, err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, nil, err
+	}
+	// Processes left over from an earlier run keep the old FIFO
+	os.Remove(path)
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		return nil, nil, err
+	}
+	rfd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	wfd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		syscall.Close(rfd)
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(rfd), path), os.NewFile(uintptr(wfd), path), nil
+}
+
+// reopenOutput captures the output of a service left running by a previous
+// daemon instance again, if the process still writes to its FIFOs. The
+// caller must hold m.mu.
+func (m *Manager) reopenOutput(name string, proc *ManagedProcess, onLine func(line []byte)) {
+	var fds []int
+	for i, suffix := range []string{".out", ".err"} {
+		path := m.outputPath(name, suffix)
+		fifo, err := os.Stat(path)
+		if err != nil {
+			break
+		}
+		// The process may have been started with other output, or its FIFO
+		// replaced since
+		stream, err := os.Stat(fmt.Sprintf("/proc/%d/fd/%d", proc.PID, i+1))
+		if err != nil || !os.SameFile(fifo, stream) {
+			break
+		}
+		fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			fmt.Printf("Failed to reopen output of service %s: %v\n", name, err)
+			break
+		}
+		fds = append(fds, fd)
+	}
+	if len(fds) < 2 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		fmt.Printf("Output of service %s is not captured\n", name)
+		return
+	}
+	m.resumeOutput(name, proc, fds[0], fds[1], onLine)
+}
+
+// attach starts copying the output once the child holds the write ends.
+// The pumps end when every process holding the pipes has exited, which may
+// be later than the main process.
+func (o *serviceOutput) attach() {
+	for _, p := range []outputPipe{o.stdout, o.stderr} {
+		p.w.Close()
+		go func(p outputPipe) {
+			defer p.r.Close()
+			logs.Pump(p.r, p.writer, o.onLine)
+		}(p)
+	}
+}
+
+// abort releases the pipes after a failed start
+func (o *serviceOutput) abort() {
+	for _, p := range []outputPipe{o.stdout, o.stderr} {
+		p.r.Close()
+		p.w.Close()
+	}
+}
+
+// StreamLogs emits the captured output of a service, see logs.Stream
+func (m *Manager) StreamLogs(ctx context.Context, name string, stderr bool, opts logs.StreamOptions, emit func(line []byte) error) error {
+	stdoutPath, stderrPath, err := m.LogPaths(name)
+	if err != nil {
+		return err
+	}
+	path := stdoutPath
+	if stderr {
+		path = stderrPath
+	}
+	return logs.Stream(ctx, path, opts, emit)
+}
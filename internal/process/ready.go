@@ -0,0 +1,187 @@
+package process
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// readyPollInterval is how often tcp and file readiness conditions are checked
+const readyPollInterval = 100 * time.Millisecond
+
+// closedChan returns a closed channel, for runs that are ready right away
+func closedChan() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// awaitReady sets up the readiness of the run that started along with done.
+// Services with a readiness condition, and forking services until their main
+// process is known, are starting until they are ready. The caller must hold
+// m.mu.
+func (m *Manager) awaitReady(name string, proc *ManagedProcess, done chan struct{}) {
+	cfg := proc.Config
+	starting := cfg.Ready != nil || cfg.Type == config.ServiceForking
+	if cfg.StartTimeout > 0 && (starting || cfg.Type == config.ServiceOneshot) {
+		time.AfterFunc(cfg.StartTimeout, func() {
+			m.startTimedOut(name, proc, done)
+		})
+	}
+
+	if !starting {
+		proc.ready = closedChan()
+		return
+	}
+	proc.ready = make(chan struct{})
+	proc.Status = StatusStarting
+
+	if cfg.Ready != nil && (cfg.Ready.TCP != "" || cfg.Ready.File != "") {
+		go m.pollReady(name, proc, done)
+	}
+}
+
+// markReady moves a starting service to running. The caller must hold m.mu.
+func (m *Manager) markReady(name string, proc *ManagedProcess) {
+	if proc.Status != StatusStarting {
+		return
+	}
+	proc.Status = StatusRunning
+	close(proc.ready)
+	fmt.Printf("Service %s is ready\n", name)
+}
+
+// pollReady checks the tcp or file readiness condition of a service until it
+// holds or the run ends
+func (m *Manager) pollReady(name string, proc *ManagedProcess, done chan struct{}) {
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	ready := proc.Config.Ready
+	path := proc.Config.ReadyFilePath()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if ready.TCP != "" {
+			conn, err := net.DialTimeout("tcp", ready.TCP, time.Second)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+		} else if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		m.mu.Lock()
+		if proc.done == done {
+			m.markReady(name, proc)
+		}
+		m.mu.Unlock()
+		return
+	}
+}
+
+// readyLogMatcher returns the function that looks for the ready log line in
+// the output of the run that started along with done, or nil
+func (m *Manager) readyLogMatcher(name string, proc *ManagedProcess, done chan struct{}) func(line []byte) {
+	if proc.Config.Ready == nil || proc.Config.Ready.Log == "" {
+		return nil
+	}
+	re, err := regexp.Compile(proc.Config.Ready.Log)
+	if err != nil {
+		return nil
+	}
+
+	var matched atomic.Bool
+	return func(line []byte) {
+		if matched.Load() || !re.Match(line) {
+			return
+		}
+		matched.Store(true)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if proc.done == done {
+			m.markReady(name, proc)
+		}
+	}
+}
+
+// startTimedOut stops a run that is still starting, or a oneshot run that is
+// still going, once its start timeout elapsed
+func (m *Manager) startTimedOut(name string, proc *ManagedProcess, done chan struct{}) {
+	m.mu.Lock()
+	oneshot := proc.Config.Type == config.ServiceOneshot
+	pending := proc.Status == StatusStarting || (oneshot && proc.Status == StatusRunning)
+	if m.processes[name] != proc || proc.done != done || proc.stopping || !pending {
+		m.mu.Unlock()
+		return
+	}
+	failure := fmt.Errorf("not ready within %s", proc.Config.StartTimeout)
+	if oneshot {
+		failure = fmt.Errorf("not finished within %s", proc.Config.StartTimeout)
+	}
+	proc.failure = failure
+	m.mu.Unlock()
+
+	fmt.Printf("Service %s was %v, stopping it\n", name, failure)
+	if _, err := m.stopService(name, false); err != nil {
+		fmt.Printf("Failed to stop service %s: %v\n", name, err)
+	}
+}
+
+// WaitReady waits until the current run of a service is ready. For oneshot
+// services it waits until the run finished, which must have succeeded.
+func (m *Manager) WaitReady(name string) error {
+	m.mu.RLock()
+	proc, exists := m.processes[name]
+	if !exists {
+		m.mu.RUnlock()
+		return fmt.Errorf("service %s not found", name)
+	}
+	ready, done := proc.ready, proc.done
+	oneshot := proc.Config.Type == config.ServiceOneshot
+	m.mu.RUnlock()
+
+	if done == nil {
+		return fmt.Errorf("service %s has not been started", name)
+	}
+	if oneshot {
+		<-done
+	} else {
+		select {
+		case <-ready:
+			return nil
+		case <-done:
+		}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	switch {
+	case oneshot && proc.Status == StatusSucceeded:
+		return nil
+	case oneshot && proc.Err != nil:
+		return fmt.Errorf("service %s failed: %w", name, proc.Err)
+	case oneshot:
+		return fmt.Errorf("service %s was stopped before it finished", name)
+	case proc.Err != nil:
+		return fmt.Errorf("service %s exited before it was ready: %w", name, proc.Err)
+	default:
+		return fmt.Errorf("service %s exited before it was ready", name)
+	}
+}
+
+// active reports whether the service has a live process
+func (p *ManagedProcess) active() bool {
+	return p.Status == StatusRunning || p.Status == StatusStarting
+}
@@ -0,0 +1,179 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// reapInterval is a safety net for SIGCHLD signals that were coalesced
+	reapInterval = time.Second
+	// unclaimedTTL is how long the exit of an unknown child is kept in case
+	// its PID is registered late
+	unclaimedTTL = time.Minute
+)
+
+// reaper collects the exit status of every child of the daemon: the
+// services and, when running as init or subreaper, orphans reparented to it.
+// Nothing else may wait for children, exec.Cmd.Wait included.
+type reaper struct {
+	mu sync.Mutex
+	// watched maps PIDs to the channel that receives their exit status
+	watched map[int]chan syscall.WaitStatus
+	// unclaimed holds exits of PIDs nobody watched yet, a service may exit
+	// before it is registered
+	unclaimed map[int]unclaimedExit
+}
+
+type unclaimedExit struct {
+	status syscall.WaitStatus
+	at     time.Time
+}
+
+func newReaper() *reaper {
+	r := &reaper{
+		watched:   make(map[int]chan syscall.WaitStatus),
+		unclaimed: make(map[int]unclaimedExit),
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+	go r.run(sigs)
+	return r
+}
+
+func (r *reaper) run(sigs chan os.Signal) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sigs:
+		case <-ticker.C:
+		}
+		r.reap()
+	}
+}
+
+// reap collects all exited children without blocking
+func (r *reaper) reap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			break
+		}
+
+		if ch, ok := r.watched[pid]; ok {
+			delete(r.watched, pid)
+			ch <- status
+			continue
+		}
+		r.unclaimed[pid] = unclaimedExit{status: status, at: time.Now()}
+	}
+
+	// Whatever nobody asked for by now was an orphan
+	cutoff := time.Now().Add(-unclaimedTTL)
+	for pid, exit := range r.unclaimed {
+		if exit.at.Before(cutoff) {
+			delete(r.unclaimed, pid)
+		}
+	}
+}
+
+// watch returns a channel that receives the exit status of the child pid
+func (r *reaper) watch(pid int) <-chan syscall.WaitStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := make(chan syscall.WaitStatus, 1)
+	if exit, ok := r.unclaimed[pid]; ok {
+		delete(r.unclaimed, pid)
+		ch <- exit.status
+		return ch
+	}
+	r.watched[pid] = ch
+	return ch
+}
+
+// unwatch forgets a PID that turned out not to be our child. It returns
+// false if the exit status was already delivered.
+func (r *reaper) unwatch(pid int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.watched[pid]; !ok {
+		return false
+	}
+	delete(r.watched, pid)
+	return true
+}
+
+// pause stops reaping until resume, children that exit meanwhile stay zombies
+func (r *reaper) pause() {
+	r.mu.Lock()
+}
+
+func (r *reaper) resume() {
+	r.mu.Unlock()
+}
+
+// exitError describes an unsuccessful exit, like exec.ExitError does for
+// processes waited for by exec.Cmd
+type exitError struct {
+	status syscall.WaitStatus
+}
+
+func (e *exitError) Error() string {
+	if e.status.Signaled() {
+		return "signal: " + e.status.Signal().String()
+	}
+	return fmt.Sprintf("exit status %d", e.status.ExitStatus())
+}
+
+// statusError returns nil for a successful exit and an *exitError otherwise
+func statusError(status syscall.WaitStatus) error {
+	if status.Exited() && status.ExitStatus() == 0 {
+		return nil
+	}
+	return &exitError{status: status}
+}
+
+// ExitCode maps the exit error of a service to a shell-style exit code: the
+// exit status, 128+n after signal n, and 1 for any other failure
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var e *exitError
+	if !errors.As(err, &e) {
+		return 1
+	}
+	if e.status.Signaled() {
+		return 128 + int(e.status.Signal())
+	}
+	return e.status.ExitStatus()
+}
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER from linux/prctl.h
+const prSetChildSubreaper = 36
+
+// BecomeSubreaper makes orphaned descendants of the daemon reparent to it
+// instead of to PID 1, so it can reap them
+func BecomeSubreaper() error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
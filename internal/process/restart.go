@@ -0,0 +1,132 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// handleExit applies the restart policy after a service exited or failed to
+// start without being asked to, and reports services that stay down.
+// The caller must hold m.mu.
+func (m *Manager) handleExit(name string, proc *ManagedProcess, exitErr error) {
+	m.restartAfterExit(name, proc, exitErr)
+	if proc.restartTimer == nil && !m.shuttingDown && m.onExit != nil {
+		m.onExit(name, exitErr)
+	}
+}
+
+func (m *Manager) restartAfterExit(name string, proc *ManagedProcess, exitErr error) {
+	cfg := proc.Config
+	if m.shuttingDown || !shouldRestart(cfg.Restart, exitErr) {
+		return
+	}
+
+	// A run that outlived the start-limit window was healthy enough,
+	// so the next failure starts again from the initial delay
+	if time.Since(proc.startedAt) >= cfg.StartLimitInterval {
+		proc.backoff = 0
+	}
+
+	// Forget starts that fell out of the window
+	cutoff := time.Now().Add(-cfg.StartLimitInterval)
+	recent := proc.starts[:0]
+	for _, t := range proc.starts {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	proc.starts = recent
+
+	if len(proc.starts) >= cfg.StartLimitBurst {
+		fmt.Printf("Service %s started %d times within %s, giving up\n", name, len(proc.starts), cfg.StartLimitInterval)
+		proc.Status = StatusCrashLoop
+		return
+	}
+
+	delay := restartDelay(cfg, proc.backoff)
+	proc.backoff++
+	fmt.Printf("Service %s exited unexpectedly (%v), restarting in %s\n", name, exitErr, delay)
+	m.scheduleRestart(name, proc, delay)
+}
+
+// shouldRestart reports whether an unexpected exit warrants a restart
+func shouldRestart(policy config.RestartPolicy, exitErr error) bool {
+	// Failing health checks ask for the restart themselves
+	if errors.Is(exitErr, errUnhealthy) {
+		return true
+	}
+	switch policy {
+	case config.RestartAlways, config.RestartUnlessStopped:
+		return true
+	case config.RestartOnFailure:
+		return exitErr != nil
+	default:
+		return false
+	}
+}
+
+// restartDelay returns the exponential backoff delay for the given attempt
+func restartDelay(cfg *config.ServiceConfig, attempt int) time.Duration {
+	delay := cfg.RestartDelay
+	for i := 0; i < attempt && delay < cfg.RestartBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > cfg.RestartBackoffMax {
+		delay = cfg.RestartBackoffMax
+	}
+	return delay
+}
+
+// scheduleRestart arranges for a service to be started again after delay.
+// The caller must hold m.mu.
+func (m *Manager) scheduleRestart(name string, proc *ManagedProcess, delay time.Duration) {
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		// Cancelled, replaced or removed while we were waiting
+		if m.processes[name] != proc || proc.restartTimer != timer {
+			return
+		}
+		proc.restartTimer = nil
+		proc.restarts++
+
+		if err := m.startLocked(name, proc); err != nil {
+			fmt.Printf("Failed to restart service %s: %v\n", name, err)
+			m.handleExit(name, proc, err)
+		}
+	})
+	proc.restartTimer = timer
+}
+
+// cancelRestart drops a pending automatic restart. The caller must hold m.mu.
+func (p *ManagedProcess) cancelRestart() bool {
+	if p.restartTimer == nil {
+		return false
+	}
+	p.restartTimer.Stop()
+	p.restartTimer = nil
+	return true
+}
+
+// ResetService clears the crash-loop state of a service so it can be started again
+func (m *Manager) ResetService(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	proc, exists := m.processes[name]
+	if !exists {
+		return fmt.Errorf("service %s not found", name)
+	}
+
+	proc.starts = nil
+	proc.backoff = 0
+	if proc.Status == StatusCrashLoop {
+		proc.Status = StatusStopped
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// exitedWith returns the exit error of a process that exited with code
+func exitedWith(code int) error {
+	return statusError(syscall.WaitStatus(code << 8))
+}
+
+// signaled returns the exit error of a process killed by sig
+func signaled(sig syscall.Signal) error {
+	return statusError(syscall.WaitStatus(sig))
+}
+
+func TestRestartDelay(t *testing.T) {
+	cfg := &config.ServiceConfig{RestartDelay: time.Second, RestartBackoffMax: 30 * time.Second}
+	want := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second,
+		// Capped from here on
+		30 * time.Second, 30 * time.Second, 30 * time.Second,
+	}
+	for attempt, w := range want {
+		if got := restartDelay(cfg, attempt); got != w {
+			t.Errorf("restartDelay(%d) = %s, want %s", attempt, got, w)
+		}
+	}
+	if got := restartDelay(cfg, 1000); got != 30*time.Second {
+		t.Errorf("restartDelay(1000) = %s, want the cap", got)
+	}
+
+	// A delay above the cap is capped right away
+	cfg = &config.ServiceConfig{RestartDelay: time.Minute, RestartBackoffMax: 10 * time.Second}
+	if got := restartDelay(cfg, 0); got != 10*time.Second {
+		t.Errorf("restartDelay above the cap = %s, want 10s", got)
+	}
+}
+
+func TestShouldRestart(t *testing.T) {
+	unhealthy := fmt.Errorf("%w 3 times in a row (%w)", errUnhealthy, signaled(syscall.SIGTERM))
+	tests := []struct {
+		policy config.RestartPolicy
+		err    error
+		want   bool
+	}{
+		{config.RestartAlways, nil, true},
+		{config.RestartAlways, exitedWith(1), true},
+		{config.RestartUnlessStopped, nil, true},
+		{config.RestartUnlessStopped, exitedWith(1), true},
+		{config.RestartOnFailure, nil, false},
+		{config.RestartOnFailure, exitedWith(1), true},
+		{config.RestartOnFailure, signaled(syscall.SIGKILL), true},
+		{config.RestartNo, nil, false},
+		{config.RestartNo, exitedWith(1), false},
+		{"", exitedWith(1), false},
+		// Failing health checks restart the service whatever the policy
+		{config.RestartNo, unhealthy, true},
+		{config.RestartOnFailure, unhealthy, true},
+	}
+	for _, tt := range tests {
+		if got := shouldRestart(tt.policy, tt.err); got != tt.want {
+			t.Errorf("shouldRestart(%q, %v) = %v, want %v", tt.policy, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRestartAfterExit(t *testing.T) {
+	cfg := &config.ServiceConfig{
+		Restart:            config.RestartAlways,
+		RestartDelay:       time.Hour,
+		RestartBackoffMax:  4 * time.Hour,
+		StartLimitBurst:    3,
+		StartLimitInterval: time.Minute,
+	}
+	now := time.Now()
+	tests := []struct {
+		name    string
+		started time.Time
+		starts  []time.Time
+		backoff int
+		// status is StatusCrashLoop when the service gives up, otherwise a
+		// restart is scheduled with the backoff raised to wantBackoff
+		status      ProcessStatus
+		wantBackoff int
+		wantStarts  int
+	}{
+		{
+			name:        "first failure",
+			started:     now,
+			starts:      []time.Time{now},
+			wantBackoff: 1,
+			wantStarts:  1,
+		},
+		{
+			name:        "backoff grows",
+			started:     now,
+			starts:      []time.Time{now.Add(-2 * time.Second), now},
+			backoff:     1,
+			wantBackoff: 2,
+			wantStarts:  2,
+		},
+		{
+			name:    "burst reached",
+			started: now,
+			starts:  []time.Time{now.Add(-20 * time.Second), now.Add(-10 * time.Second), now},
+			backoff: 2,
+			status:  StatusCrashLoop,
+		},
+		{
+			name:        "old starts fall out of the window",
+			started:     now,
+			starts:      []time.Time{now.Add(-3 * time.Minute), now.Add(-2 * time.Minute), now},
+			backoff:     2,
+			wantBackoff: 3,
+			wantStarts:  1,
+		},
+		{
+			name:        "long run resets the backoff",
+			started:     now.Add(-2 * time.Minute),
+			starts:      []time.Time{now.Add(-2 * time.Minute)},
+			backoff:     5,
+			wantBackoff: 1,
+			wantStarts:  0,
+		},
+	}
+	for _, tt := range tests {
+		m := &Manager{processes: make(map[string]*ManagedProcess)}
+		proc := &ManagedProcess{
+			Config:    cfg,
+			Status:    StatusStopped,
+			startedAt: tt.started,
+			starts:    tt.starts,
+			backoff:   tt.backoff,
+		}
+		m.processes["svc"] = proc
+		m.restartAfterExit("svc", proc, exitedWith(1))
+		scheduled := proc.cancelRestart()
+
+		if tt.status == StatusCrashLoop {
+			if proc.Status != StatusCrashLoop || scheduled {
+				t.Errorf("%s: status %s, restart scheduled %v, want crash-loop", tt.name, proc.Status, scheduled)
+			}
+			continue
+		}
+		if !scheduled {
+			t.Errorf("%s: no restart scheduled", tt.name)
+		}
+		if proc.backoff != tt.wantBackoff {
+			t.Errorf("%s: backoff = %d, want %d", tt.name, proc.backoff, tt.wantBackoff)
+		}
+		if len(proc.starts) != tt.wantStarts {
+			t.Errorf("%s: %d starts in the window, want %d", tt.name, len(proc.starts), tt.wantStarts)
+		}
+	}
+
+	// Nothing is restarted during shutdown
+	m := &Manager{processes: make(map[string]*ManagedProcess), shuttingDown: true}
+	proc := &ManagedProcess{Config: cfg, startedAt: now}
+	m.processes["svc"] = proc
+	m.restartAfterExit("svc", proc, exitedWith(1))
+	if proc.cancelRestart() {
+		t.Error("restart scheduled during shutdown")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{exitedWith(0), 0},
+		{exitedWith(3), 3},
+		{exitedWith(255), 255},
+		{signaled(syscall.SIGKILL), 128 + 9},
+		{signaled(syscall.SIGTERM), 128 + 15},
+		// Wrapped by the daemon
+		{fmt.Errorf("%w (%w)", errOOMKill, signaled(syscall.SIGKILL)), 137},
+		{errors.New("failed to start"), 1},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNewRun(t *testing.T) {
+	started := time.Now().Add(-time.Minute)
+	tests := []struct {
+		err      error
+		stopped  bool
+		code     int
+		result   RunResult
+		hasError bool
+	}{
+		{nil, false, 0, RunSuccess, false},
+		{exitedWith(2), false, 2, RunFailure, true},
+		{signaled(syscall.SIGSEGV), false, 128 + 11, RunFailure, true},
+		{errExitUnknown, false, -1, RunFailure, true},
+		{fmt.Errorf("%w (%w)", errUnhealthy, errExitUnknown), false, -1, RunFailure, true},
+		// Stopped on request, whatever the exit status says
+		{signaled(syscall.SIGTERM), true, 128 + 15, RunStopped, true},
+		{nil, true, 0, RunStopped, false},
+	}
+	for _, tt := range tests {
+		run := newRun(started, tt.err, tt.stopped)
+		if run.ExitCode != tt.code || run.Result != tt.result || (run.Error != "") != tt.hasError {
+			t.Errorf("newRun(%v, %v) = %d %s %q, want %d %s", tt.err, tt.stopped, run.ExitCode, run.Result, run.Error, tt.code, tt.result)
+		}
+		if !run.StartedAt.Equal(started) || run.Duration() < time.Minute {
+			t.Errorf("newRun(%v) started %s, took %s", tt.err, run.StartedAt, run.Duration())
+		}
+	}
+}
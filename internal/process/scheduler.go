@@ -0,0 +1,110 @@
+package process
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+	"github.com/Magnetkopf/Eternal/internal/schedule"
+)
+
+// armSchedule sets the timer for the next scheduled run of a service, if it
+// has a schedule. The caller must hold m.mu.
+func (m *Manager) armSchedule(name string, proc *ManagedProcess) {
+	if proc.scheduleTimer != nil {
+		proc.scheduleTimer.Stop()
+		proc.scheduleTimer = nil
+	}
+	proc.nextRun = time.Time{}
+	if proc.Config.Schedule == "" {
+		return
+	}
+
+	sched, err := schedule.Parse(proc.Config.Schedule)
+	if err != nil {
+		fmt.Printf("Not scheduling service %s: %v\n", name, err)
+		return
+	}
+	next := sched.Next(time.Now())
+	if next.IsZero() {
+		return
+	}
+
+	// The timer is identified by its arm number, which the callback compares
+	// under the lock
+	proc.scheduleArm++
+	arm := proc.scheduleArm
+	proc.scheduleTimer = time.AfterFunc(time.Until(next), func() {
+		m.runScheduled(name, proc, arm)
+	})
+	proc.nextRun = next
+}
+
+// runScheduled starts a scheduled run, applying the concurrency policy if
+// the previous run is still going
+func (m *Manager) runScheduled(name string, proc *ManagedProcess, arm uint64) {
+	m.mu.Lock()
+	// Rescheduled, removed or shutting down while the timer fired
+	if m.processes[name] != proc || proc.scheduleArm != arm || proc.scheduleTimer == nil || m.shuttingDown {
+		m.mu.Unlock()
+		return
+	}
+	m.armSchedule(name, proc)
+
+	busy := proc.active()
+	policy := proc.Config.ConcurrencyPolicy
+	if busy && policy == config.ConcurrencyQueue {
+		proc.queued = true
+	}
+	m.mu.Unlock()
+
+	if busy {
+		switch policy {
+		case config.ConcurrencyQueue:
+			fmt.Printf("Scheduled run of service %s queued, previous run still going\n", name)
+			return
+		case config.ConcurrencyReplace:
+			fmt.Printf("Scheduled run of service %s replaces the previous run\n", name)
+			if _, err := m.stopService(name, false); err != nil {
+				fmt.Printf("Failed to stop previous run of service %s: %v\n", name, err)
+				return
+			}
+		default:
+			fmt.Printf("Scheduled run of service %s skipped, previous run still going\n", name)
+			return
+		}
+	}
+
+	if err := m.StartService(name); err != nil {
+		fmt.Printf("Scheduled run of service %s failed to start: %v\n", name, err)
+	}
+}
+
+// startQueued starts the run queued while the previous one was going. The
+// caller must hold m.mu.
+func (m *Manager) startQueued(name string, proc *ManagedProcess) {
+	if !proc.queued || proc.restartTimer != nil || m.shuttingDown {
+		return
+	}
+	proc.queued = false
+	go func() {
+		if err := m.StartService(name); err != nil {
+			fmt.Printf("Queued run of service %s failed to start: %v\n", name, err)
+		}
+	}()
+}
+
+// NextRuns returns the time of the next scheduled run of every scheduled
+// service
+func (m *Manager) NextRuns() map[string]time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make(map[string]time.Time)
+	for name, proc := range m.processes {
+		if !proc.nextRun.IsZero() {
+			result[name] = proc.nextRun
+		}
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"syscall"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// activeServices returns the services with a live process, most recently
+// started first. The caller must hold m.mu.
+func (m *Manager) activeServices() []string {
+	var names []string
+	for name, proc := range m.processes {
+		if proc.active() {
+			names = append(names, name)
+		}
+	}
+	m.sortBySeq(names)
+	return names
+}
+
+func (m *Manager) sortBySeq(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		return m.processes[names[i]].seq > m.processes[names[j]].seq
+	})
+}
+
+// stopOrder returns the active services in reverse dependency order, so
+// services are stopped before what they require or are ordered after.
+// Unrelated services keep the most recently started first order.
+// The caller must hold m.mu.
+func (m *Manager) stopOrder() []string {
+	names := m.activeServices()
+	graph, err := config.NewDependencyGraph(m.configsLocked())
+	if err != nil {
+		return names
+	}
+
+	levels := graph.Levels(names)
+	var order []string
+	for i := len(levels) - 1; i >= 0; i-- {
+		m.sortBySeq(levels[i])
+		order = append(order, levels[i]...)
+	}
+	return order
+}
+
+// beginShutdown stops all automatic restarts and refuses further starts
+func (m *Manager) beginShutdown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.shuttingDown = true
+	for _, proc := range m.processes {
+		proc.cancelRestart()
+	}
+}
+
+// StopAll stops every running service in reverse dependency order, each with
+// its own stop signal and timeout. Services still running when ctx
+// is done are killed. No service is started or restarted afterwards.
+func (m *Manager) StopAll(ctx context.Context) error {
+	m.beginShutdown()
+
+	m.mu.RLock()
+	names := m.stopOrder()
+	m.mu.RUnlock()
+
+	for _, name := range names {
+		result := make(chan error, 1)
+		go func() {
+			_, err := m.stopService(name, false)
+			result <- err
+		}()
+
+		select {
+		case err := <-result:
+			if err != nil {
+				fmt.Printf("Failed to stop service %s: %v\n", name, err)
+			}
+		case <-ctx.Done():
+			m.KillAll()
+			return fmt.Errorf("timed out stopping services: %w", ctx.Err())
+		}
+	}
+	return nil
+}
+
+// KillAll immediately kills every running service with SIGKILL
+func (m *Manager) KillAll() {
+	m.beginShutdown()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, name := range m.activeServices() {
+		proc := m.processes[name]
+		proc.stopping = true
+		signalService(proc.PID, proc.pgid, proc.Config.KillMode, syscall.SIGKILL)
+	}
+}
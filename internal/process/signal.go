@@ -0,0 +1,170 @@
+package process
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Magnetkopf/Eternal/internal/config"
+)
+
+// signalService delivers sig to the processes of a service selected by mode.
+// Every service is started in its own process group, pgid is the group of
+// the main process, which differs from its PID for some forking services.
+func signalService(pid, pgid int, mode config.KillMode, sig syscall.Signal) error {
+	switch mode {
+	case config.KillProcess:
+		return syscall.Kill(pid, sig)
+	case config.KillTree:
+		// Collect descendants first, the tree falls apart once signalled
+		descendants := findDescendants(pid)
+		err := syscall.Kill(-pgid, sig)
+		for _, child := range descendants {
+			syscall.Kill(child, sig)
+		}
+		return err
+	default:
+		return syscall.Kill(-pgid, sig)
+	}
+}
+
+// processGroup returns the process group of pid, or pid itself if it is gone
+func processGroup(pid int) int {
+	fields, ok := readStat(pid)
+	if !ok || len(fields) < 3 {
+		return pid
+	}
+	pgid, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return pid
+	}
+	return pgid
+}
+
+// isDescendant reports whether pid is a descendant of the daemon
+func isDescendant(pid int) bool {
+	self := os.Getpid()
+	for i := 0; i < 64 && pid > 1; i++ {
+		ppid, ok := readPPID(pid)
+		if !ok {
+			return false
+		}
+		if ppid == self {
+			return true
+		}
+		pid = ppid
+	}
+	return false
+}
+
+// groupAlive reports whether any live process is left in the process group.
+// Zombies waiting to be reaped by their new parent do not count.
+func groupAlive(pgid int) bool {
+	if syscall.Kill(-pgid, 0) != nil {
+		return false
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return true
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fields, ok := readStat(pid)
+		if ok && len(fields) > 2 && fields[2] == strconv.Itoa(pgid) && fields[0] != "Z" {
+			return true
+		}
+	}
+	return false
+}
+
+// findDescendants returns the PIDs of all descendants of pid by walking /proc
+func findDescendants(pid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		ppid, ok := readPPID(child)
+		if !ok {
+			continue
+		}
+		children[ppid] = append(children[ppid], child)
+	}
+
+	var result []int
+	queue := []int{pid}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, child := range children[current] {
+			result = append(result, child)
+			queue = append(queue, child)
+		}
+	}
+	return result
+}
+
+// readPPID reads the parent PID from /proc/<pid>/stat
+func readPPID(pid int) (int, bool) {
+	fields, ok := readStat(pid)
+	if !ok || len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, false
+	}
+	return ppid, true
+}
+
+// processStartTicks returns the start time of a process in clock ticks since
+// boot, which together with the PID identifies a process across PID reuse
+func processStartTicks(pid int) (uint64, bool) {
+	fields, ok := readStat(pid)
+	if !ok || len(fields) < 20 {
+		return 0, false
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return ticks, true
+}
+
+// processMatches reports whether pid is still the live process that started
+// at ticks
+func processMatches(pid int, ticks uint64) bool {
+	fields, ok := readStat(pid)
+	if !ok || len(fields) < 20 || fields[0] == "Z" {
+		return false
+	}
+	return fields[19] == strconv.FormatUint(ticks, 10)
+}
+
+// readStat returns the fields of /proc/<pid>/stat that follow the command
+// name, starting with the state
+func readStat(pid int) ([]string, bool) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, false
+	}
+	// The command name may contain spaces, so parse after the closing paren
+	stat := string(data)
+	end := strings.LastIndexByte(stat, ')')
+	if end < 0 {
+		return nil, false
+	}
+	return strings.Fields(stat[end+1:]), true
+}
@@ -0,0 +1,129 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// adoptPollInterval is how often a process that was not started by this
+// daemon instance is checked for liveness
+const adoptPollInterval = 500 * time.Millisecond
+
+// errExitUnknown is the exit error of adopted processes, whose exit status
+// cannot be collected because they are not children of this daemon
+var errExitUnknown = errors.New("process exited, exit status unknown")
+
+// serviceState is the persisted runtime state of a running service
+type serviceState struct {
+	PID        int       `yaml:"pid"`
+	StartTicks uint64    `yaml:"start_ticks"`
+	StartedAt  time.Time `yaml:"started_at"`
+}
+
+// saveState writes the running services to the state file, so that a
+// restarted daemon can find them again. The caller must hold m.mu.
+func (m *Manager) saveState() {
+	state := make(map[string]serviceState)
+	for name, proc := range m.processes {
+		if proc.PID == 0 {
+			continue
+		}
+		state[name] = serviceState{
+			PID:        proc.PID,
+			StartTicks: proc.startTicks,
+			StartedAt:  proc.startedAt,
+		}
+	}
+
+	if err := writeFileAtomic(m.stateFile, state); err != nil {
+		fmt.Printf("Failed to save state: %v\n", err)
+	}
+}
+
+// writeFileAtomic writes v as YAML, replacing path in one step
+func writeFileAtomic(path string, v interface{}) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", filepath.Base(path), err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// AdoptRunning re-attaches to services that are still running from a
+// previous daemon instance, according to the state file. It must be called
+// after LoadServices and before any service is started. It returns the names
+// of the adopted services.
+func (m *Manager) AdoptRunning() []string {
+	data, err := os.ReadFile(m.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Failed to read state: %v\n", err)
+		}
+		return nil
+	}
+
+	var state map[string]serviceState
+	if err := yaml.Unmarshal(data, &state); err != nil {
+		fmt.Printf("Failed to parse state: %v\n", err)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var adopted []string
+	for name, st := range state {
+		proc, exists := m.processes[name]
+		if !exists {
+			fmt.Printf("Service %s (PID %d) is running but no longer configured, leaving it alone\n", name, st.PID)
+			continue
+		}
+		// The PID may have been reused by an unrelated process
+		if !processMatches(st.PID, st.StartTicks) {
+			continue
+		}
+
+		done := make(chan struct{})
+		m.startSeq++
+		proc.seq = m.startSeq
+		proc.PID = st.PID
+		proc.startTicks = st.StartTicks
+		proc.startedAt = st.StartedAt
+		proc.starts = append(proc.starts, st.StartedAt)
+		proc.Status = StatusRunning
+		proc.ready = closedChan()
+		proc.done = done
+		if usesNotify(proc) {
+			if _, err := m.listenNotify(name, proc); err != nil {
+				fmt.Printf("Service %s: %v\n", name, err)
+			}
+		}
+		proc.pgid = processGroup(st.PID)
+		m.reopenOutput(name, proc, m.readyLogMatcher(name, proc, done))
+		go m.supervise(name, proc, done, "", func() error {
+			return m.waitPID(st.PID, st.StartTicks)
+		})
+		m.watchHealth(name, proc, done)
+		m.armWatchdog(name, proc, done)
+		proc.cgroup = m.cgroupPath(name)
+		proc.oomKills = oomKills(proc.cgroup)
+
+		adopted = append(adopted, name)
+	}
+
+	m.saveState()
+	return adopted
+}
@@ -0,0 +1,176 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the unit of the CPU times in /proc/<pid>/stat (USER_HZ),
+// which is 100 on every Linux architecture
+const clockTicks = 100
+
+// minSampleInterval is the shortest interval CPU usage is measured over
+const minSampleInterval = time.Second
+
+// Stats is a sample of the resource usage of a running service, summed over
+// all its processes
+type Stats struct {
+	PID int `json:"pid"`
+	// Processes counts the processes of the service, the main one included
+	Processes int `json:"processes"`
+	// CPUPercent is the CPU usage since the previous sample, or on average
+	// since the start for the first one. 100 is one busy CPU.
+	CPUPercent float64 `json:"cpu_percent"`
+	// CPUSeconds is the CPU time used by the live processes
+	CPUSeconds float64 `json:"cpu_seconds"`
+	// MemoryRSS is the resident memory in bytes
+	MemoryRSS uint64 `json:"memory_rss"`
+	Threads   int    `json:"threads"`
+	// FDs counts open file descriptors, of the processes the daemon may
+	// inspect
+	FDs    int           `json:"fds"`
+	Uptime time.Duration `json:"uptime"`
+}
+
+// cpuSample is the CPU time of a run at one point, to compute CPU usage
+type cpuSample struct {
+	done    chan struct{}
+	ticks   uint64
+	at      time.Time
+	percent float64
+}
+
+// Stats samples the resource usage of a running service from /proc. The
+// processes of a service are those in its cgroup, or else the main process,
+// its descendants and its process group. It returns nil for services that
+// are not running.
+func (m *Manager) Stats(name string) (*Stats, error) {
+	m.mu.RLock()
+	proc, exists := m.processes[name]
+	if !exists {
+		m.mu.RUnlock()
+		return nil, fmt.Errorf("service %s not found", name)
+	}
+	pid, pgid, cgroup, done := proc.PID, proc.pgid, proc.cgroup, proc.done
+	startedAt, prev := proc.startedAt, proc.cpuSample
+	m.mu.RUnlock()
+
+	if pid == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	stats, ticks := sampleUsage(pid, pgid, cgroup)
+	stats.Uptime = now.Sub(startedAt)
+
+	// Usage since the previous sample of this run, if the processes did not
+	// shrink in the meantime. Samples close together repeat the last value,
+	// CPU times are too coarse to measure short intervals.
+	elapsed := now.Sub(prev.at)
+	switch {
+	case prev.done == done && elapsed < minSampleInterval:
+		stats.CPUPercent = prev.percent
+		return stats, nil
+	case prev.done == done && ticks >= prev.ticks:
+		stats.CPUPercent = float64(ticks-prev.ticks) / clockTicks / elapsed.Seconds() * 100
+	case stats.Uptime > 0:
+		stats.CPUPercent = stats.CPUSeconds / stats.Uptime.Seconds() * 100
+	}
+
+	m.mu.Lock()
+	if proc.done == done {
+		proc.cpuSample = cpuSample{done: done, ticks: ticks, at: now, percent: stats.CPUPercent}
+	}
+	m.mu.Unlock()
+	return stats, nil
+}
+
+// sampleUsage sums the resource usage of the processes of a service, and
+// returns their CPU time in clock ticks as well
+func sampleUsage(pid, pgid int, cgroup string) (*Stats, uint64) {
+	stats := &Stats{PID: pid}
+	var ticks uint64
+	for _, p := range serviceProcesses(pid, pgid, cgroup) {
+		fields, ok := readStat(p)
+		// Fields 14, 15, 20 and 24 of the stat file: utime, stime, threads
+		// and RSS in pages
+		if !ok || len(fields) < 22 || fields[0] == "Z" {
+			continue
+		}
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		threads, _ := strconv.Atoi(fields[17])
+		rss, _ := strconv.ParseUint(fields[21], 10, 64)
+
+		stats.Processes++
+		ticks += utime + stime
+		stats.Threads += threads
+		stats.MemoryRSS += rss * uint64(os.Getpagesize())
+		if fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", p)); err == nil {
+			stats.FDs += len(fds)
+		}
+	}
+	stats.CPUSeconds = float64(ticks) / clockTicks
+	return stats, ticks
+}
+
+// serviceProcesses returns the PIDs of the processes of a service
+func serviceProcesses(pid, pgid int, cgroup string) []int {
+	if cgroup != "" {
+		if pids, err := cgroupProcesses(cgroup); err == nil && len(pids) > 0 {
+			return pids
+		}
+	}
+
+	seen := map[int]bool{pid: true}
+	pids := []int{pid}
+	members := findDescendants(pid)
+	if pgid > 0 {
+		members = append(members, groupMembers(pgid)...)
+	}
+	for _, p := range members {
+		if !seen[p] {
+			seen[p] = true
+			pids = append(pids, p)
+		}
+	}
+	return pids
+}
+
+// cgroupProcesses returns the PIDs in a cgroup
+func cgroupProcesses(cgroup string) ([]int, error) {
+	data, err := os.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// groupMembers returns the PIDs in a process group by walking /proc
+func groupMembers(pgid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if fields, ok := readStat(pid); ok && len(fields) > 2 && fields[2] == strconv.Itoa(pgid) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
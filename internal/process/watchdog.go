@@ -0,0 +1,70 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// errWatchdogTimeout is the reason of runs ended because the service stopped
+// sending keep-alive pings
+var errWatchdogTimeout = errors.New("watchdog-timeout")
+
+// watchdogEnv returns the environment telling a service how often to ping,
+// in the format of systemd's WATCHDOG_USEC
+func watchdogEnv(proc *ManagedProcess) []string {
+	if proc.Config.WatchdogSec <= 0 {
+		return nil
+	}
+	usec := time.Duration(proc.Config.WatchdogSec) * time.Second / time.Microsecond
+	return []string{"WATCHDOG_USEC=" + strconv.FormatInt(int64(usec), 10)}
+}
+
+// armWatchdog starts the watchdog of the run that started along with done.
+// The caller must hold m.mu.
+func (m *Manager) armWatchdog(name string, proc *ManagedProcess, done chan struct{}) {
+	proc.stopWatchdog()
+	if proc.Config.WatchdogSec <= 0 {
+		return
+	}
+	proc.watchdog = time.AfterFunc(time.Duration(proc.Config.WatchdogSec)*time.Second, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.watchdogExpired(name, proc, done)
+	})
+}
+
+// feedWatchdog restarts the watchdog period after a ping. The caller must
+// hold m.mu.
+func (p *ManagedProcess) feedWatchdog() {
+	if p.watchdog != nil {
+		p.watchdog.Reset(time.Duration(p.Config.WatchdogSec) * time.Second)
+	}
+}
+
+// stopWatchdog disarms the watchdog. The caller must hold m.mu.
+func (p *ManagedProcess) stopWatchdog() {
+	if p.watchdog != nil {
+		p.watchdog.Stop()
+		p.watchdog = nil
+	}
+}
+
+// watchdogExpired stops a service that missed its keep-alive ping. The run
+// counts as failed, so the restart policy decides whether it comes back.
+// The caller must hold m.mu.
+func (m *Manager) watchdogExpired(name string, proc *ManagedProcess, done chan struct{}) {
+	if m.processes[name] != proc || proc.done != done || proc.stopping || !proc.active() {
+		return
+	}
+	proc.stopWatchdog()
+	proc.failure = fmt.Errorf("%w: no keep-alive ping within %ds", errWatchdogTimeout, proc.Config.WatchdogSec)
+	fmt.Printf("Service %s: %v, stopping it\n", name, proc.failure)
+
+	go func() {
+		if _, err := m.stopService(name, false); err != nil {
+			fmt.Printf("Failed to stop service %s: %v\n", name, err)
+		}
+	}()
+}
@@ -0,0 +1,136 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	atBerlin := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", s, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		// 2025-01-01 is a Wednesday
+		{"* * * * *", at("2025-01-01 10:00:30"), at("2025-01-01 10:01:00")},
+		{"* * * * *", at("2025-01-01 10:00:00"), at("2025-01-01 10:01:00")},
+		{"30 2 * * *", at("2025-01-01 10:00:00"), at("2025-01-02 02:30:00")},
+		{"0 9-17 * * *", at("2025-01-01 17:30:00"), at("2025-01-02 09:00:00")},
+		{"*/15 * * * *", at("2025-01-01 10:16:00"), at("2025-01-01 10:30:00")},
+		{"5/20 * * * *", at("2025-01-01 10:26:00"), at("2025-01-01 10:45:00")},
+		{"0 8-18/4 * * *", at("2025-01-01 12:01:00"), at("2025-01-01 16:00:00")},
+		{"0 0 1,15 * *", at("2025-01-02 00:00:00"), at("2025-01-15 00:00:00")},
+		{"0 0 * jun-aug *", at("2025-01-01 00:00:00"), at("2025-06-01 00:00:00")},
+		{"0 0 * * mon", at("2025-01-01 00:00:00"), at("2025-01-06 00:00:00")},
+		{"0 0 * * SAT,sun", at("2025-01-01 00:00:00"), at("2025-01-04 00:00:00")},
+		// Sunday is 0 and 7
+		{"0 0 * * 7", at("2025-01-01 00:00:00"), at("2025-01-05 00:00:00")},
+		// Both day fields restricted: either matches
+		{"0 0 13 * 5", at("2025-01-01 00:00:00"), at("2025-01-03 00:00:00")},
+		{"0 0 13 * 5", at("2025-01-11 00:00:00"), at("2025-01-13 00:00:00")},
+		// Only one restricted: the other one does not widen it
+		{"0 0 13 * *", at("2025-01-01 00:00:00"), at("2025-01-13 00:00:00")},
+		// Month and year rollover
+		{"0 0 31 * *", at("2025-01-31 00:00:00"), at("2025-03-31 00:00:00")},
+		{"59 23 31 12 *", at("2025-12-31 23:59:00"), at("2026-12-31 23:59:00")},
+		{"0 0 29 2 *", at("2025-01-01 00:00:00"), at("2028-02-29 00:00:00")},
+		// Descriptors
+		{"@hourly", at("2025-01-01 10:00:00"), at("2025-01-01 11:00:00")},
+		{"@daily", at("2025-01-01 10:00:00"), at("2025-01-02 00:00:00")},
+		{"@midnight", at("2025-01-01 10:00:00"), at("2025-01-02 00:00:00")},
+		{"@weekly", at("2025-01-01 10:00:00"), at("2025-01-05 00:00:00")},
+		{"@monthly", at("2025-01-15 10:00:00"), at("2025-02-01 00:00:00")},
+		{"@yearly", at("2025-01-15 10:00:00"), at("2026-01-01 00:00:00")},
+		{"@annually", at("2025-01-15 10:00:00"), at("2026-01-01 00:00:00")},
+		{"@every 90s", at("2025-01-01 10:00:10"), at("2025-01-01 10:01:40")},
+		{"@every 1h30m", at("2025-01-01 10:00:00"), at("2025-01-01 11:30:00")},
+		// Clocks in Berlin jump from 02:00 to 03:00 on 2025-03-30, the
+		// missing time is skipped that day
+		{"30 2 * * *", atBerlin("2025-03-29 12:00:00"), atBerlin("2025-03-31 02:30:00")},
+		{"30 3 * * *", atBerlin("2025-03-30 01:00:00"), atBerlin("2025-03-30 03:30:00")},
+		{"0 * * * *", atBerlin("2025-03-30 01:30:00"), atBerlin("2025-03-30 03:00:00")},
+		// and back from 03:00 to 02:00 on 2025-10-26
+		{"0 4 * * *", atBerlin("2025-10-26 01:00:00"), atBerlin("2025-10-26 04:00:00")},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).Next(%s) = %s, want %s", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestNextFallBack(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 02:00 CEST (00:00 UTC) is followed by 02:00 CET (01:00 UTC) on
+	// 2025-10-26, an hourly schedule fires in both hours
+	s, err := Parse("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2025, 10, 25, 23, 30, 0, 0, time.UTC).In(berlin)
+	want := []time.Time{
+		time.Date(2025, 10, 26, 0, 0, 0, 0, time.UTC),
+		time.Date(2025, 10, 26, 1, 0, 0, 0, time.UTC),
+		time.Date(2025, 10, 26, 2, 0, 0, 0, time.UTC),
+	}
+	for _, w := range want {
+		got := s.Next(from)
+		if !got.Equal(w) {
+			t.Fatalf("Next(%s) = %s, want %s", from, got, w.In(berlin))
+		}
+		from = got
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"* * * foo *",
+		"0 0 30 2 *",
+		"@every 500ms",
+		"@every soon",
+		"@sometimes",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+#!/bin/bash
+# Init mode fixture: a service leaves a burst of orphans behind, which the
+# daemon must reap, and the daemon must exit with the code of its primary
+# service. Run from the repository root after build.sh.
+set -e
+
+DAEMON="$(pwd)/eternal-daemon"
+export HOME="$(mktemp -d)"
+trap 'rm -rf "$HOME"' EXIT
+
+mkdir -p "$HOME/.eternal/services"
+cat > "$HOME/.eternal/config.yaml" <<CONFIG
+token: "the-test-token"
+api_port: 19094
+init: true
+primary: main
+CONFIG
+
+# A bounded fork bomb: every process forks two children and exits
+# immediately, so the whole tree is reparented to the daemon
+cat > "$HOME/.eternal/services/orphans.yaml" <<'SERVICE'
+shell: true
+exec: |
+  echo $$ > "$HOME/orphans.pgid"
+  spawn() {
+    if [ "$1" -gt 0 ]; then
+      (spawn $(($1 - 1)) &)
+      (spawn $(($1 - 1)) &)
+    fi
+    sleep 0.2
+  }
+  spawn 7
+  sleep 30
+SERVICE
+
+cat > "$HOME/.eternal/services/main.yaml" <<'SERVICE'
+shell: true
+exec: sleep 4; exit 7
+SERVICE
+
+echo "- orphans" > "$HOME/.eternal/enabled.yaml"
+
+"$DAEMON" > "$HOME/daemon.log" 2>&1 &
+DAEMON_PID=$!
+echo "Started daemon with PID $DAEMON_PID"
+
+sleep 3
+
+# Direct children of the daemon that are zombies
+ZOMBIES=$(ps -o stat= --ppid "$DAEMON_PID" | grep -c '^Z' || true)
+echo "Zombie children of the daemon: $ZOMBIES"
+if [ "$ZOMBIES" -ne 0 ]; then
+    echo "FAIL: orphans were not reaped"
+    kill -9 "$DAEMON_PID"
+    exit 1
+fi
+
+set +e
+wait "$DAEMON_PID"
+CODE=$?
+set -e
+
+cat "$HOME/daemon.log"
+echo "Daemon exited with $CODE"
+if [ "$CODE" -ne 7 ]; then
+    echo "FAIL: expected the exit code of the primary service (7)"
+    exit 1
+fi
+
+if pgrep -g "$(cat "$HOME/orphans.pgid")" > /dev/null; then
+    echo "FAIL: the orphans service is still running"
+    exit 1
+fi
+
+echo "PASS"